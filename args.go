@@ -217,3 +217,31 @@ func encodeSmethodArgs(args Args) string {
 
 	return strings.Join(pairs, ",")
 }
+
+// Encode a name–value mapping so that it is suitable to go in a SOCKS
+// username/password; the inverse of parseClientParameters. The output is
+// sorted by key.
+//
+// "First the '<Key>=<Value>' formatted arguments MUST be escaped, such that all
+// backslash, equal sign, and semicolon characters are escaped with a
+// backslash."
+func encodeClientParameters(args Args) string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escape := func(s string) string {
+		return backslashEscape(s, []byte{'=', ';'})
+	}
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range args[key] {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+
+	return strings.Join(pairs, ";")
+}
@@ -372,3 +372,45 @@ func TestEncodeSmethodArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeClientParameters(t *testing.T) {
+	tests := [...]struct {
+		args     Args
+		expected string
+	}{
+		{
+			nil,
+			"",
+		},
+		{
+			Args{},
+			"",
+		},
+		{
+			Args{"j": []string{"v1", "v2"}, "k": []string{"v1"}},
+			"j=v1;j=v2;k=v1",
+		},
+		{
+			Args{"=;\\": []string{"=", ";", "\\"}},
+			"\\=\\;\\\\=\\=;\\=\\;\\\\=\\;;\\=\\;\\\\=\\\\",
+		},
+		{
+			Args{"shared-secret": []string{"rahasia"}, "secrets-0": []string{"1,2,3"}},
+			"secrets-0=1,2,3;shared-secret=rahasia",
+		},
+	}
+
+	for _, test := range tests {
+		encoded := encodeClientParameters(test.args)
+		if encoded != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.args, encoded, test.expected)
+		}
+		// Encoding and then parsing must give back the same Args.
+		args, err := parseClientParameters(encoded)
+		if err != nil {
+			t.Errorf("%q → %q does not parse: %s", test.args, encoded, err)
+		} else if !argsEqual(args, test.args) {
+			t.Errorf("%q → %q → %q", test.args, encoded, args)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package pt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A Controller speaks the managed proxy protocol to tor on behalf of one
+// pluggable transport, writing protocol messages to its own io.Writer. It is
+// safe to call a Controller's methods from multiple goroutines; messages are
+// written one at a time, never interleaved.
+//
+// A Controller keeps track of where it is in the handshake with tor (VERSION,
+// then PROXY for a client, then the method lines, then METHODS DONE). A line
+// that is out of sequence is still emitted, as it always has been, but the
+// method that emitted it returns an error wrapping ErrBadSequence. Set Strict to
+// drop such lines instead of emitting them, or Debug to panic.
+//
+// The package-level functions, such as ClientSetup, Cmethod, and Log, use a
+// default Controller that writes to Stdout. Create your own Controller if you
+// need to write messages somewhere else, for example to run more than one
+// managed transport in the same process:
+// 	c := pt.NewController(w)
+// 	ptInfo, err := c.ClientSetup(env)
+// 	...
+// 	c.Cmethod(methodName, ln.Version(), ln.Addr())
+// 	c.CmethodsDone()
+type Controller struct {
+	// If Debug is true, an attempt to emit a message out of sequence causes
+	// a panic instead of returning an error.
+	Debug bool
+	// If Strict is true, a message out of sequence is not emitted. The
+	// error is returned either way.
+	Strict bool
+
+	w     io.Writer
+	mu    sync.Mutex
+	role  ptRole
+	phase ptPhase
+}
+
+// Return a new Controller that writes protocol messages to w.
+func NewController(w io.Writer) *Controller {
+	return &Controller{w: w}
+}
+
+// Whether a Controller is being used by a client or a server transport.
+type ptRole int
+
+const (
+	roleUnknown ptRole = iota
+	roleClient
+	roleServer
+)
+
+// The phases of the managed proxy handshake with tor. A Controller moves
+// forward through these as it emits lines.
+type ptPhase int
+
+const (
+	// Nothing sent yet.
+	phaseStart ptPhase = iota
+	// VERSION sent.
+	phaseVersion
+	// PROXY DONE sent (client only).
+	phaseProxy
+	// At least one CMETHOD, SMETHOD, CMETHOD-ERROR, or SMETHOD-ERROR sent.
+	phaseMethods
+	// CMETHODS DONE or SMETHODS DONE sent.
+	phaseDone
+	// ENV-ERROR, VERSION-ERROR, or PROXY-ERROR sent. Nothing further but
+	// LOG and STATUS is allowed.
+	phaseFailed
+)
+
+// ErrBadSequence is wrapped by the errors returned when a message is emitted
+// out of order, for example a CMETHOD line after CMETHODS DONE, an SMETHOD
+// line from a client, or any method line before VERSION. Test for it with
+// errors.Is.
+var ErrBadSequence = errors.New("managed proxy message out of sequence")
+
+// An io.Writer that writes to whatever Stdout currently is, so that the
+// default Controller respects reassignment of Stdout.
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	return Stdout.Write(p)
+}
+
+// The Controller used by the package-level functions.
+var defaultController = NewController(stdoutWriter{})
+
+// Start a new handshake as the given role, forgetting any previous state.
+// ClientSetup and ServerSetup call this before emitting anything.
+func (c *Controller) begin(role ptRole) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+	c.phase = phaseStart
+}
+
+// Return the phase that c would be in after emitting a line with the given
+// keyword, or an error wrapping ErrBadSequence if the line is not allowed in
+// the current phase. c.mu must be held.
+func (c *Controller) nextPhase(keyword string, v []string) (ptPhase, error) {
+	name := keyword
+	if len(v) > 0 && (keyword == "CMETHODS" || keyword == "SMETHODS" || keyword == "PROXY") {
+		name += " " + v[0]
+	}
+	bad := func(format string, a ...interface{}) (ptPhase, error) {
+		return c.phase, fmt.Errorf("%s %s: %w", name, fmt.Sprintf(format, a...), ErrBadSequence)
+	}
+
+	switch keyword {
+	case "LOG", "STATUS":
+		return c.phase, nil
+	case "VERSION", "VERSION-ERROR":
+		if c.phase != phaseStart {
+			return bad("after VERSION")
+		}
+		if keyword == "VERSION-ERROR" {
+			return phaseFailed, nil
+		}
+		return phaseVersion, nil
+	}
+
+	switch c.phase {
+	case phaseDone:
+		return bad("after METHODS DONE")
+	case phaseFailed:
+		return bad("after a fatal error")
+	}
+	if keyword == "ENV-ERROR" {
+		return phaseFailed, nil
+	}
+	if c.phase == phaseStart {
+		return bad("before VERSION")
+	}
+
+	var role ptRole
+	switch keyword {
+	case "PROXY", "PROXY-ERROR", "CMETHOD", "CMETHOD-ERROR", "CMETHODS":
+		role = roleClient
+	case "SMETHOD", "SMETHOD-ERROR", "SMETHODS":
+		role = roleServer
+	default:
+		return bad("is not a known message")
+	}
+	if c.role == roleClient && role == roleServer {
+		return bad("from a client")
+	}
+	if c.role == roleServer && role == roleClient {
+		return bad("from a server")
+	}
+
+	switch keyword {
+	case "PROXY", "PROXY-ERROR":
+		if c.phase == phaseProxy {
+			return bad("after PROXY DONE")
+		}
+		if c.phase == phaseMethods {
+			return bad("after CMETHOD")
+		}
+		if keyword == "PROXY-ERROR" {
+			return phaseFailed, nil
+		}
+		return phaseProxy, nil
+	case "CMETHODS", "SMETHODS":
+		return phaseDone, nil
+	default:
+		return phaseMethods, nil
+	}
+}
+
+// Print a pluggable transports protocol line to c's writer. The line consists
+// of a keyword followed by any number of space-separated arg strings. Panics if
+// there are forbidden bytes in the keyword or the args (pt-spec.txt 2.2.1).
+// Returns an error wrapping ErrBadSequence if the line is not allowed in the
+// current phase of the handshake. In that case the line is printed anyway,
+// without changing the phase, unless c.Strict is set; or line panics if
+// c.Debug is set.
+func (c *Controller) line(keyword string, v ...string) error {
+	s := formatline(keyword, v...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next, err := c.nextPhase(keyword, v)
+	if err != nil {
+		if c.Debug {
+			panic(err)
+		}
+		if !c.Strict {
+			fmt.Fprintln(c.w, s)
+		}
+		return err
+	}
+	fmt.Fprintln(c.w, s)
+	c.phase = next
+	return nil
+}
+
+// Emit and return the given error. If the line is out of sequence and c.Strict
+// is set, it is not emitted, and the sequence error is returned instead.
+func (c *Controller) doError(e *ProtocolError) error {
+	err := c.line(e.Keyword, e.args()...)
+	if err != nil && c.Strict {
+		return err
+	}
+	return e
+}
+
+// Emit an ENV-ERROR line with explanation text. Returns a representation of the
+// error.
+func (c *Controller) envError(msg string) error {
+	return c.envErrorCause(msg, nil)
+}
+
+// Like envError, but the returned error wraps cause.
+func (c *Controller) envErrorCause(msg string, cause error) error {
+	return c.doError(&ProtocolError{Keyword: "ENV-ERROR", Msg: msg, Err: cause})
+}
+
+// Emit a VERSION-ERROR line with explanation text. Returns a representation of
+// the error.
+func (c *Controller) versionError(msg string) error {
+	return c.doError(&ProtocolError{Keyword: "VERSION-ERROR", Msg: msg})
+}
+
+// Emit a CMETHOD-ERROR line on c. See CmethodError.
+func (c *Controller) CmethodError(methodName, msg string) error {
+	return c.doError(&ProtocolError{Keyword: "CMETHOD-ERROR", MethodName: methodName, Msg: msg})
+}
+
+// Emit an SMETHOD-ERROR line on c. See SmethodError.
+func (c *Controller) SmethodError(methodName, msg string) error {
+	return c.doError(&ProtocolError{Keyword: "SMETHOD-ERROR", MethodName: methodName, Msg: msg})
+}
+
+// Emit a PROXY-ERROR line on c. See ProxyError.
+func (c *Controller) ProxyError(msg string) error {
+	return c.proxyErrorCause(msg, nil)
+}
+
+// Like ProxyError, but the returned error wraps cause.
+func (c *Controller) proxyErrorCause(msg string, cause error) error {
+	return c.doError(&ProtocolError{Keyword: "PROXY-ERROR", Msg: msg, Err: cause})
+}
+
+// Emit a CMETHOD line on c. See Cmethod.
+func (c *Controller) Cmethod(name string, socks string, addr net.Addr) error {
+	return c.line("CMETHOD", name, socks, addr.String())
+}
+
+// Emit a CMETHODS DONE line on c. See CmethodsDone.
+func (c *Controller) CmethodsDone() error {
+	return c.line("CMETHODS", "DONE")
+}
+
+// Emit an SMETHOD line on c. See Smethod.
+func (c *Controller) Smethod(name string, addr net.Addr) error {
+	return c.line("SMETHOD", name, addr.String())
+}
+
+// Emit an SMETHOD line with an ARGS option on c. See SmethodArgs.
+func (c *Controller) SmethodArgs(name string, addr net.Addr, args Args) error {
+	return c.line("SMETHOD", name, addr.String(), "ARGS:"+encodeSmethodArgs(args))
+}
+
+// Emit an SMETHODS DONE line on c. See SmethodsDone.
+func (c *Controller) SmethodsDone() error {
+	return c.line("SMETHODS", "DONE")
+}
+
+// Emit a PROXY DONE line on c. See ProxyDone.
+func (c *Controller) ProxyDone() error {
+	return c.line("PROXY", "DONE")
+}
+
+// Emit a LOG message on c. See Log.
+func (c *Controller) Log(severity logSeverity, message string) {
+	// "<Message> contains the log message which can be a String or CString..."
+	// encodeCString always makes the string safe to emit; i.e., it
+	// satisfies argIsSafe.
+	c.line("LOG", "SEVERITY="+severity.string, "MESSAGE="+encodeCString(message))
+}
+
+// Emit a STATUS message on c. See Status.
+func (c *Controller) Status(methodName string, kv Args) {
+	c.line("STATUS", formatStatusArgs(methodName, kv)...)
+}
@@ -0,0 +1,210 @@
+package pt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Return a Controller that is as if it had just emitted VERSION for the given
+// role, without writing the VERSION line to w.
+func newTestController(w io.Writer, role ptRole) *Controller {
+	c := NewController(w)
+	c.begin(role)
+	c.phase = phaseVersion
+	return c
+}
+
+func TestControllerWriter(t *testing.T) {
+	var buf1, buf2 bytes.Buffer
+	c1 := newTestController(&buf1, roleClient)
+	c2 := newTestController(&buf2, roleServer)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	c1.Cmethod("foo", "socks5", addr)
+	c1.CmethodsDone()
+	c2.Smethod("bar", addr)
+	c2.SmethodsDone()
+
+	if buf1.String() != "CMETHOD foo socks5 127.0.0.1:1234\nCMETHODS DONE\n" {
+		t.Errorf("first controller wrote %q", buf1.String())
+	}
+	if buf2.String() != "SMETHOD bar 127.0.0.1:1234\nSMETHODS DONE\n" {
+		t.Errorf("second controller wrote %q", buf2.String())
+	}
+}
+
+func TestControllerSetup(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewController(&buf)
+	_, err := c.ClientSetup(EnvMap{
+		"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+		"TOR_PT_CLIENT_TRANSPORTS":     "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "VERSION 1\n" {
+		t.Errorf("ClientSetup wrote %q", buf.String())
+	}
+
+	buf.Reset()
+	_, err = c.ServerSetup(EnvMap{})
+	if err == nil {
+		t.Fatal("ServerSetup with empty environment unexpectedly succeeded")
+	}
+	if !strings.HasPrefix(buf.String(), "ENV-ERROR ") {
+		t.Errorf("ServerSetup wrote %q", buf.String())
+	}
+}
+
+func TestControllerConcurrentWrites(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewController(&buf)
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Log(LogSeverityNotice, fmt.Sprintf("message %d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("got %d lines, expected %d", len(lines), n)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "LOG SEVERITY=notice MESSAGE=\"message ") {
+			t.Errorf("garbled line %q", line)
+		}
+	}
+}
+
+func TestControllerSequence(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	cmethod := func(c *Controller) error { return c.Cmethod("foo", "socks5", addr) }
+	cmethodError := func(c *Controller) error { return c.CmethodError("foo", "msg") }
+	cmethodsDone := func(c *Controller) error { return c.CmethodsDone() }
+	smethod := func(c *Controller) error { return c.Smethod("foo", addr) }
+	smethodsDone := func(c *Controller) error { return c.SmethodsDone() }
+	proxyDone := func(c *Controller) error { return c.ProxyDone() }
+	proxyError := func(c *Controller) error { return c.ProxyError("msg") }
+	envError := func(c *Controller) error { return c.envError("msg") }
+
+	tests := [...]struct {
+		role  ptRole
+		calls []func(*Controller) error
+		ok    bool
+	}{
+		{roleClient, []func(*Controller) error{cmethod, cmethod, cmethodsDone}, true},
+		{roleClient, []func(*Controller) error{proxyDone, cmethod, cmethodError, cmethodsDone}, true},
+		{roleClient, []func(*Controller) error{cmethodsDone}, true},
+		{roleServer, []func(*Controller) error{smethod, smethodsDone}, true},
+		{roleClient, []func(*Controller) error{cmethodsDone, cmethod}, false},
+		{roleClient, []func(*Controller) error{cmethodsDone, cmethodsDone}, false},
+		{roleClient, []func(*Controller) error{proxyDone, proxyDone}, false},
+		{roleClient, []func(*Controller) error{cmethod, proxyDone}, false},
+		{roleClient, []func(*Controller) error{proxyError, cmethod}, false},
+		{roleClient, []func(*Controller) error{envError, cmethodsDone}, false},
+		{roleClient, []func(*Controller) error{smethod}, false},
+		{roleClient, []func(*Controller) error{smethodsDone}, false},
+		{roleServer, []func(*Controller) error{cmethod}, false},
+		{roleServer, []func(*Controller) error{proxyDone}, false},
+		{roleServer, []func(*Controller) error{smethodsDone, smethod}, false},
+	}
+
+	for _, strict := range []bool{false, true} {
+		for i, test := range tests {
+			var buf bytes.Buffer
+			c := newTestController(&buf, test.role)
+			c.Strict = strict
+			last := len(test.calls) - 1
+			for _, call := range test.calls[:last] {
+				call(c)
+			}
+			before := buf.Len()
+			err := test.calls[last](c)
+			if test.ok {
+				if err != nil && !isPtErr(err) {
+					t.Errorf("test %d: unexpected error: %s", i, err)
+				}
+				continue
+			}
+			// Error lines return a *ProtocolError unless Strict.
+			if !errors.Is(err, ErrBadSequence) && (strict || !isPtErr(err)) {
+				t.Errorf("test %d (strict %v): expected ErrBadSequence, got %v", i, strict, err)
+			}
+			if strict && buf.Len() != before {
+				t.Errorf("test %d: out-of-sequence line was written in Strict mode: %q", i, buf.String()[before:])
+			}
+			if !strict && buf.Len() == before {
+				t.Errorf("test %d: out-of-sequence line was not written", i)
+			}
+		}
+	}
+
+	// Nothing but LOG is allowed before VERSION.
+	var buf bytes.Buffer
+	c := NewController(&buf)
+	c.Strict = true
+	if err := cmethod(c); !errors.Is(err, ErrBadSequence) {
+		t.Errorf("CMETHOD before VERSION: expected ErrBadSequence, got %v", err)
+	}
+	c.Log(LogSeverityNotice, "msg")
+	if buf.String() != "LOG SEVERITY=notice MESSAGE=\"msg\"\n" {
+		t.Errorf("LOG before VERSION wrote %q", buf.String())
+	}
+}
+
+// TestControllerCompat tests that, without Strict, a transport that emits
+// lines out of sequence behaves as it did before sequences were checked: every
+// line is written.
+func TestControllerCompat(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewController(&buf)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	// No VERSION; CMETHOD after CMETHODS DONE; PROXY DONE after CMETHOD.
+	if err := c.Cmethod("foo", "socks5", addr); !errors.Is(err, ErrBadSequence) {
+		t.Errorf("CMETHOD before VERSION: expected ErrBadSequence, got %v", err)
+	}
+	c.begin(roleClient)
+	c.line("VERSION", "1")
+	c.CmethodsDone()
+	if err := c.Cmethod("bar", "socks5", addr); !errors.Is(err, ErrBadSequence) {
+		t.Errorf("CMETHOD after CMETHODS DONE: expected ErrBadSequence, got %v", err)
+	}
+	if err := c.ProxyDone(); !errors.Is(err, ErrBadSequence) {
+		t.Errorf("PROXY DONE after CMETHODS DONE: expected ErrBadSequence, got %v", err)
+	}
+	expected := "CMETHOD foo socks5 127.0.0.1:1234\nVERSION 1\nCMETHODS DONE\nCMETHOD bar socks5 127.0.0.1:1234\nPROXY DONE\n"
+	if buf.String() != expected {
+		t.Errorf("wrote %q (expected %q)", buf.String(), expected)
+	}
+}
+
+func isPtErr(err error) bool {
+	_, ok := err.(*ProtocolError)
+	return ok
+}
+
+func TestControllerDebug(t *testing.T) {
+	c := newTestController(ioutil.Discard, roleClient)
+	c.Debug = true
+	c.CmethodsDone()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("out-of-sequence CMETHODS DONE did not panic in Debug mode")
+		}
+	}()
+	c.CmethodsDone()
+}
@@ -0,0 +1,119 @@
+package pt
+
+import (
+	"context"
+	"net"
+)
+
+// A Dialer makes outgoing connections. *net.Dialer, *OutboundDialer,
+// *SocksDialer, and the dialers returned by NewProxyDialer satisfy this
+// interface.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// OutboundDialer makes outgoing TCP connections from the local addresses
+// requested by tor in TOR_PT_OUTBOUND_BIND_ADDRESS_V4 and
+// TOR_PT_OUTBOUND_BIND_ADDRESS_V6. The local address is chosen according to
+// the address family of each destination address. If there is no bind address
+// for an address family, the operating system chooses the local address as
+// usual.
+//
+// 	func handler(conn *pt.SocksConn) error {
+// 		defer conn.Close()
+// 		remote, err := ptInfo.OutboundDialer().Dial("tcp", conn.Req.Target)
+// 		if err != nil {
+// 			conn.RejectError(err)
+// 			return err
+// 		}
+// 		...
+// 	}
+type OutboundDialer struct {
+	// Options such as Timeout and KeepAlive are taken from the embedded
+	// net.Dialer. Its LocalAddr field is ignored.
+	net.Dialer
+	BindAddrV4 *net.TCPAddr
+	BindAddrV6 *net.TCPAddr
+}
+
+// Return an OutboundDialer that uses info.OutboundBindAddrV4 and
+// info.OutboundBindAddrV6.
+func (info *ClientInfo) OutboundDialer() *OutboundDialer {
+	return &OutboundDialer{
+		BindAddrV4: info.OutboundBindAddrV4,
+		BindAddrV6: info.OutboundBindAddrV6,
+	}
+}
+
+// Dial connects to address on the named network, which must be "tcp", "tcp4",
+// or "tcp6".
+func (d *OutboundDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, but takes a context.
+//
+// If address contains a host name rather than an IP address, the name is
+// resolved and the resulting addresses are tried in order until one succeeds.
+func (d *OutboundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if d.BindAddrV4 == nil && d.BindAddrV6 == nil {
+		dialer := d.Dialer
+		dialer.LocalAddr = nil
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		resolver := d.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	var firstErr error
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		if (network == "tcp4" && !isV4) || (network == "tcp6" && isV4) {
+			continue
+		}
+		dialer := d.Dialer
+		dialer.LocalAddr = nil
+		if isV4 && d.BindAddrV4 != nil {
+			dialer.LocalAddr = d.BindAddrV4
+		} else if !isV4 && d.BindAddrV6 != nil {
+			dialer.LocalAddr = d.BindAddrV6
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,81 @@
+package pt
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestOutboundDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	bindAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	d := &OutboundDialer{BindAddrV4: bindAddr}
+	for _, address := range []string{
+		ln.Addr().String(),
+		net.JoinHostPort("localhost", strconv.Itoa(port)),
+	} {
+		conn, err := d.Dial("tcp", address)
+		if err != nil {
+			t.Errorf("%q unexpectedly returned an error: %s", address, err)
+			continue
+		}
+		local := conn.LocalAddr().(*net.TCPAddr)
+		if !local.IP.Equal(bindAddr.IP) {
+			t.Errorf("%q → local address %s (expected %s)", address, local, bindAddr.IP)
+		}
+		conn.Close()
+	}
+
+	// No IPv4 address is acceptable with "tcp6".
+	_, err = d.Dial("tcp6", ln.Addr().String())
+	if err == nil {
+		t.Errorf("tcp6 dial of %s unexpectedly succeeded", ln.Addr())
+	}
+
+	for _, network := range []string{"udp", "unix", ""} {
+		_, err = d.Dial(network, ln.Addr().String())
+		if err == nil {
+			t.Errorf("network %q unexpectedly succeeded", network)
+		}
+	}
+
+	// The embedded net.Dialer's LocalAddr is ignored, with or without bind
+	// addresses. A *net.UDPAddr would make a TCP dial fail.
+	for _, d := range []*OutboundDialer{
+		{Dialer: net.Dialer{LocalAddr: &net.UDPAddr{}}},
+		{Dialer: net.Dialer{LocalAddr: &net.UDPAddr{}}, BindAddrV4: bindAddr},
+	} {
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Errorf("LocalAddr was not ignored with BindAddrV4 %v: %s", d.BindAddrV4, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestClientInfoOutboundDialer(t *testing.T) {
+	info := ClientInfo{
+		OutboundBindAddrV4: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+		OutboundBindAddrV6: &net.TCPAddr{IP: net.ParseIP("1:2::3:4")},
+	}
+	d := info.OutboundDialer()
+	if d.BindAddrV4 != info.OutboundBindAddrV4 || d.BindAddrV6 != info.OutboundBindAddrV6 {
+		t.Errorf("OutboundDialer → %+v (expected bind addresses from %+v)", d, info)
+	}
+}
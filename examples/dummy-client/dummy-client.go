@@ -11,18 +11,17 @@
 package main
 
 import (
+	"context"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 )
 
 import "git.torproject.org/pluggable-transports/goptlib.git"
 
 var ptInfo pt.ClientInfo
+var dialer pt.Dialer
 
 func copyLoop(a, b net.Conn) {
 	var wg sync.WaitGroup
@@ -42,13 +41,13 @@ func copyLoop(a, b net.Conn) {
 
 func handler(conn *pt.SocksConn) error {
 	defer conn.Close()
-	remote, err := net.Dial("tcp", conn.Req.Target)
+	remote, err := dialer.Dial("tcp", conn.Req.Target)
 	if err != nil {
-		conn.Reject()
+		conn.RejectError(err)
 		return err
 	}
 	defer remote.Close()
-	err = conn.Grant(remote.RemoteAddr().(*net.TCPAddr))
+	err = conn.GrantAddr(remote.LocalAddr())
 	if err != nil {
 		return err
 	}
@@ -80,46 +79,41 @@ func main() {
 		os.Exit(1)
 	}
 
-	if ptInfo.ProxyURL != nil {
-		pt.ProxyError("proxy is not supported")
+	// Emits PROXY DONE or PROXY-ERROR if tor asked for an upstream proxy.
+	dialer, err = ptInfo.ProxyDialer()
+	if err != nil {
 		os.Exit(1)
 	}
 
-	listeners := make([]net.Listener, 0)
+	listeners := make([]*pt.TrackedListener, 0)
 	for _, methodName := range ptInfo.MethodNames {
 		switch methodName {
 		case "dummy":
-			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+			tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
 			if err != nil {
 				pt.CmethodError(methodName, err.Error())
 				break
 			}
+			tracked := pt.NewTrackedListener(tcpLn)
+			ln := pt.NewSocksListener(tracked)
 			go acceptLoop(ln)
 			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-			listeners = append(listeners, ln)
+			listeners = append(listeners, tracked)
 		default:
 			pt.CmethodError(methodName, "no such method")
 		}
 	}
 	pt.CmethodsDone()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
-
-	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
-		// This environment variable means we should treat EOF on stdin
-		// just like SIGTERM: https://bugs.torproject.org/15435.
-		go func() {
-			io.Copy(ioutil.Discard, os.Stdin)
-			sigChan <- syscall.SIGTERM
-		}()
-	}
+	drain, exit, stop := pt.SignalContext(context.Background())
+	defer stop()
 
 	// wait for a signal
-	<-sigChan
+	<-drain.Done()
 
-	// signal received, shut down
+	// signal received, stop accepting and let existing connections run
+	// until they finish or it is time to exit
 	for _, ln := range listeners {
-		ln.Close()
+		ln.Shutdown(exit)
 	}
 }
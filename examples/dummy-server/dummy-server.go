@@ -12,13 +12,11 @@
 package main
 
 import (
+	"context"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 )
 
 import "git.torproject.org/pluggable-transports/goptlib.git"
@@ -77,15 +75,16 @@ func main() {
 		os.Exit(1)
 	}
 
-	listeners := make([]net.Listener, 0)
+	listeners := make([]*pt.TrackedListener, 0)
 	for _, bindaddr := range ptInfo.Bindaddrs {
 		switch bindaddr.MethodName {
 		case "dummy":
-			ln, err := net.ListenTCP("tcp", bindaddr.Addr)
+			tcpLn, err := net.ListenTCP("tcp", bindaddr.Addr)
 			if err != nil {
 				pt.SmethodError(bindaddr.MethodName, err.Error())
 				break
 			}
+			ln := pt.NewTrackedListener(tcpLn)
 			go acceptLoop(ln)
 			pt.Smethod(bindaddr.MethodName, ln.Addr())
 			listeners = append(listeners, ln)
@@ -95,23 +94,15 @@ func main() {
 	}
 	pt.SmethodsDone()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM)
-
-	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
-		// This environment variable means we should treat EOF on stdin
-		// just like SIGTERM: https://bugs.torproject.org/15435.
-		go func() {
-			io.Copy(ioutil.Discard, os.Stdin)
-			sigChan <- syscall.SIGTERM
-		}()
-	}
+	drain, exit, stop := pt.SignalContext(context.Background())
+	defer stop()
 
 	// wait for a signal
-	<-sigChan
+	<-drain.Done()
 
-	// signal received, shut down
+	// signal received, stop accepting and let existing connections run
+	// until they finish or it is time to exit
 	for _, ln := range listeners {
-		ln.Close()
+		ln.Shutdown(exit)
 	}
 }
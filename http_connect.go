@@ -0,0 +1,461 @@
+package pt
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpConnectListener is an alternative to SocksListener for applications that
+// can use only an HTTP proxy. It accepts HTTP CONNECT requests and returns
+// HttpConnectConns, which have the same Req field and Grant and Reject methods
+// as a SocksConn, so that a transport client can serve both kinds of proxy
+// client with the same code:
+// 	type proxyConn interface {
+// 		net.Conn
+// 		Grant(*net.TCPAddr) error
+// 		RejectError(error) error
+// 	}
+// 	func handler(conn proxyConn, req *pt.SocksRequest) error {
+// 		...
+// 	}
+// 	...
+// 	go handler(socksConn, &socksConn.Req)
+// 	go handler(httpConn, &httpConn.Req)
+//
+// Pluggable transport arguments are taken from a Proxy-Authorization header
+// using the Basic scheme: the username and password are joined and parsed with
+// the same escaping as SOCKS arguments. The credentials are split at the first
+// colon that is not escaped with a backslash, so a colon in an argument must be
+// escaped.
+// 	Proxy-Authorization: Basic base64("shared-secret=rahasia;secret-key=qwerty:")
+// Other Proxy-Authorization schemes are rejected.
+//
+// An HttpConnectListener created with NewHttpConnectListenerConfig takes its
+// options from a SocksListenerConfig, so that both kinds of listener can share
+// one. These fields apply, as they do for SOCKS: HandshakeTimeout,
+// MaxConcurrentHandshakes, HandshakeErrorHook, AcceptHook, and RequestHook.
+// ValidateCredentials is called with the Proxy-Authorization username and
+// password of each request that has them; if it returns an error, or if
+// AuthMethods does not include SocksAuthNoneRequired and the request has no
+// credentials, the client gets "407 Proxy Authentication Required". The other
+// fields do not apply.
+type HttpConnectListener struct {
+	net.Listener
+	config SocksListenerConfig
+
+	loop handshakeLoop
+	errs handshakeErrorCounts
+}
+
+// The most bytes of request line and header that a client may send, like
+// http.Server.MaxHeaderBytes.
+const httpConnectMaxHeaderBytes = 32 << 10
+
+// Open a net.Listener according to network and laddr, and return it as an
+// HttpConnectListener.
+func ListenHttpConnect(network, laddr string) (*HttpConnectListener, error) {
+	ln, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewHttpConnectListener(ln), nil
+}
+
+// Create a new HttpConnectListener wrapping the given net.Listener.
+func NewHttpConnectListener(ln net.Listener) *HttpConnectListener {
+	return &HttpConnectListener{Listener: ln}
+}
+
+// Create a new HttpConnectListener wrapping the given net.Listener, with the
+// options in config that apply to HTTP.
+// 	config := pt.SocksListenerConfig{HandshakeTimeout: 10 * time.Second}
+// 	socksLn := pt.NewSocksListenerConfig(tcpLn1, config)
+// 	httpLn := pt.NewHttpConnectListenerConfig(tcpLn2, config)
+func NewHttpConnectListenerConfig(ln net.Listener, config SocksListenerConfig) *HttpConnectListener {
+	return &HttpConnectListener{Listener: ln, config: config}
+}
+
+// Accept is the same as AcceptHttpConnect, except that it returns a generic
+// net.Conn. It is present for the sake of satisfying the net.Listener
+// interface.
+func (ln *HttpConnectListener) Accept() (net.Conn, error) {
+	return ln.AcceptHttpConnect()
+}
+
+// Return the next connection whose CONNECT request has been read. As with
+// SocksListener.AcceptSocks, requests are read from several connections at
+// once, and those that fail are answered with an error status and closed
+// without being returned. Reply to the request with conn.Grant or
+// conn.Reject.
+func (ln *HttpConnectListener) AcceptHttpConnect() (*HttpConnectConn, error) {
+	ln.init()
+	c, err := ln.loop.accept()
+	if err != nil {
+		return nil, err
+	}
+	return c.(*HttpConnectConn), nil
+}
+
+// Close the wrapped net.Listener. Connections whose requests are still being
+// read are closed instead of being returned by AcceptHttpConnect.
+func (ln *HttpConnectListener) Close() error {
+	ln.init()
+	ln.loop.close()
+	return ln.Listener.Close()
+}
+
+// Return the number of connections that have failed the handshake, reading
+// the CONNECT request, with an error of the given kind.
+func (ln *HttpConnectListener) HandshakeErrorCount(kind SocksHandshakeErrorKind) uint64 {
+	return ln.errs.get(kind)
+}
+
+// Start the accept loop, the first time this is called.
+func (ln *HttpConnectListener) init() {
+	ln.loop.init(ln.Listener, ln.config.maxConcurrentHandshakes(), func(c net.Conn) (net.Conn, error) {
+		conn, err := ln.handshake(c)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// Read the CONNECT request on c and return an HttpConnectConn. On error, c is
+// closed, and the error is counted and passed to config.HandshakeErrorHook.
+func (ln *HttpConnectListener) handshake(c net.Conn) (*HttpConnectConn, error) {
+	conn, err := ln.handshakeConn(c)
+	if err != nil {
+		return nil, ln.errs.add(c.RemoteAddr(), err, ln.config.HandshakeErrorHook)
+	}
+	return conn, nil
+}
+
+// The body of handshake, without the error accounting.
+func (ln *HttpConnectListener) handshakeConn(c net.Conn) (*HttpConnectConn, error) {
+	// Until the handshake is done, close c rather than conn, because
+	// httpConnectHandshake sends its own error responses.
+	if ln.config.AcceptHook != nil {
+		err := ln.config.AcceptHook(c)
+		if err != nil {
+			c.Close()
+			return nil, &SocksHandshakeError{Kind: SocksErrRejected, Err: err}
+		}
+	}
+	err := c.SetDeadline(time.Now().Add(ln.config.handshakeTimeout()))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn, err := httpConnectHandshake(c, &ln.config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if ln.config.RequestHook != nil {
+		code := ln.config.RequestHook(&conn.Req)
+		if code != socksRepSucceeded {
+			conn.RejectReason(code)
+			conn.Close()
+			return nil, socksKindError(SocksErrRejected, "CONNECT request rejected with code 0x%02x", code)
+		}
+	}
+	err = c.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// HttpConnectConn is a connection accepted by an HttpConnectListener. Its
+// methods behave like those of SocksConn: data cannot be read or written until
+// the request is granted, only one reply may be sent, and closing the
+// connection without a reply rejects the request.
+type HttpConnectConn struct {
+	net.Conn
+	// The request, converted to a SOCKS request. Command is always
+	// SocksCmdConnect and Version is 0.
+	Req SocksRequest
+
+	// Holds any data the client sent after its request header.
+	r *bufio.Reader
+
+	mu    sync.Mutex
+	state socksReplyState
+}
+
+// Send a response with the given status code, and move to state next. Returns
+// an error without sending anything if a reply has already been sent.
+func (conn *HttpConnectConn) reply(next socksReplyState, status int) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.state != socksNoReply {
+		return errSocksReplied
+	}
+	// Even if sending fails, do not try again.
+	conn.state = next
+	return sendHttpConnectResponse(conn.Conn, status)
+}
+
+// Report whether the request has been granted.
+func (conn *HttpConnectConn) granted() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.state == socksGranted
+}
+
+// Read data relayed from the client. Returns an error if the request has not
+// been granted.
+func (conn *HttpConnectConn) Read(b []byte) (int, error) {
+	if !conn.granted() {
+		return 0, errSocksNotGranted
+	}
+	return conn.r.Read(b)
+}
+
+// Write data to be relayed to the client. Returns an error if the request has
+// not been granted.
+func (conn *HttpConnectConn) Write(b []byte) (int, error) {
+	if !conn.granted() {
+		return 0, errSocksNotGranted
+	}
+	return conn.Conn.Write(b)
+}
+
+// Close the connection. If no reply has been sent, a "502 Bad Gateway"
+// response is sent first, so the client is not left waiting for one.
+func (conn *HttpConnectConn) Close() error {
+	conn.mu.Lock()
+	if conn.state == socksNoReply {
+		// Swallow the error; the connection is being closed anyway.
+		sendHttpConnectResponse(conn.Conn, http.StatusBadGateway)
+		conn.state = socksRejected
+	}
+	conn.mu.Unlock()
+	return conn.Conn.Close()
+}
+
+// Send a "200 Connection established" response to the client. addr is not
+// used, because HTTP has no way to report the address of the outgoing
+// connection; it is there to match SocksConn.Grant. Returns an error if a
+// reply has already been sent.
+func (conn *HttpConnectConn) Grant(addr *net.TCPAddr) error {
+	return conn.reply(socksGranted, http.StatusOK)
+}
+
+// Like Grant, but takes any net.Addr, which is likewise not used.
+func (conn *HttpConnectConn) GrantAddr(addr net.Addr) error {
+	return conn.reply(socksGranted, http.StatusOK)
+}
+
+// Send a "502 Bad Gateway" response to the client. RejectReason should be used
+// if more specific error reporting is desired.
+func (conn *HttpConnectConn) Reject() error {
+	return conn.RejectReason(SocksRepGeneralFailure)
+}
+
+// Send an error response to the client, with a status code that corresponds
+// to the given SOCKS5 reply code: "403 Forbidden" for
+// SocksRepConnectionNotAllowed, "504 Gateway Timeout" for SocksRepTTLExpired,
+// and "502 Bad Gateway" for the others. Returns an error if a reply has
+// already been sent.
+func (conn *HttpConnectConn) RejectReason(reason byte) error {
+	return conn.reply(socksRejected, httpStatusForSocksRep(reason))
+}
+
+// Send an error response to the client, with a status code chosen according
+// to err, as in SocksConn.RejectError.
+func (conn *HttpConnectConn) RejectError(err error) error {
+	return conn.RejectReason(socksRepForError(err))
+}
+
+// Return the HTTP error status code that best corresponds to a SOCKS5 reply
+// code.
+func httpStatusForSocksRep(code byte) int {
+	switch code {
+	case SocksRepConnectionNotAllowed:
+		return http.StatusForbidden
+	case SocksRepTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// Send a response to a CONNECT request with the given status code. Error
+// responses ask the client to close the connection.
+func sendHttpConnectResponse(w io.Writer, status int) error {
+	if status == http.StatusOK {
+		_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	var extra string
+	if status == http.StatusProxyAuthRequired {
+		extra = "Proxy-Authenticate: Basic realm=\"pluggable transport\"\r\n"
+	}
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status), extra)
+	return err
+}
+
+// Returned when the request line and header are longer than
+// httpConnectMaxHeaderBytes.
+var errHttpHeaderTooLarge = errors.New("HTTP request header too large")
+
+// Return the status code of the error response to a request that failed with
+// err, which must be a *SocksHandshakeError.
+func httpStatusForHandshakeError(err *SocksHandshakeError) int {
+	if errors.Is(err, errHttpHeaderTooLarge) {
+		return http.StatusRequestHeaderFieldsTooLarge
+	}
+	switch err.Kind {
+	case SocksErrUnsupportedCommand:
+		return http.StatusMethodNotAllowed
+	case SocksErrAuthFailed:
+		return http.StatusProxyAuthRequired
+	}
+	return http.StatusBadRequest
+}
+
+// Read a CONNECT request from c and return an HttpConnectConn for it. config
+// may be nil. On failure, an error response is sent: "405 Method Not Allowed"
+// if the request is not a CONNECT request, "407 Proxy Authentication Required"
+// if its credentials are missing or refused, "431 Request Header Fields Too
+// Large" if its header is longer than httpConnectMaxHeaderBytes, and "400 Bad
+// Request" for any other problem with the request. If reading the request
+// times out or otherwise fails, no response is sent.
+func httpConnectHandshake(c net.Conn, config *SocksListenerConfig) (conn *HttpConnectConn, err error) {
+	defer func() {
+		// Answer bad requests, but not timeouts and other I/O errors,
+		// after which the connection is no use.
+		var reqErr *SocksHandshakeError
+		if errors.As(err, &reqErr) {
+			// Swallow errors that occur when writing the response,
+			// connection will be closed anyway.
+			sendHttpConnectResponse(c, httpStatusForHandshakeError(reqErr))
+		}
+	}()
+
+	// Limit the header the way net/http does, with allowance for what
+	// bufio.Reader reads ahead; then lift the limit for the data that
+	// follows.
+	lr := &io.LimitedReader{R: c, N: httpConnectMaxHeaderBytes + 4096}
+	r := bufio.NewReader(lr)
+	httpReq, err := http.ReadRequest(r)
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case lr.N == 0:
+			err = &SocksHandshakeError{Kind: SocksErrMalformed, Err: errHttpHeaderTooLarge}
+		case errors.As(err, &netErr), err == io.EOF, err == io.ErrUnexpectedEOF:
+			// Leave timeouts and disconnections to be classified
+			// as such.
+		default:
+			err = &SocksHandshakeError{Kind: SocksErrMalformed, Err: err}
+		}
+		return
+	}
+	lr.N = math.MaxInt64
+	if httpReq.Method != http.MethodConnect {
+		err = socksKindError(SocksErrUnsupportedCommand, "HTTP request had unsupported method %q", httpReq.Method)
+		return
+	}
+	conn = &HttpConnectConn{Conn: c, r: r}
+	if err = httpConnectParseRequest(httpReq, &conn.Req); err != nil {
+		return nil, err
+	}
+
+	hasCreds := httpReq.Header.Get("Proxy-Authorization") != ""
+	if !hasCreds && !config.authMethodEnabled(SocksAuthNoneRequired) {
+		err = socksKindError(SocksErrAuthFailed, "CONNECT request had no Proxy-Authorization header")
+		return nil, err
+	}
+	if hasCreds && config != nil && config.ValidateCredentials != nil {
+		if err = config.ValidateCredentials(conn.Req.Username, conn.Req.Password, conn.Req.Args); err != nil {
+			err = &SocksHandshakeError{Kind: SocksErrAuthFailed, Err: fmt.Errorf("Proxy-Authorization credentials rejected: %w", err)}
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Fill in req from the target and Proxy-Authorization header of a CONNECT
+// request.
+func httpConnectParseRequest(httpReq *http.Request, req *SocksRequest) error {
+	host, portStr, err := net.SplitHostPort(httpReq.URL.Host)
+	if err != nil {
+		return &SocksHandshakeError{Kind: SocksErrMalformed, Err: err}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return socksKindError(SocksErrMalformed, "CONNECT request had bad port %q", portStr)
+	}
+	if host == "" {
+		return socksKindError(SocksErrMalformed, "CONNECT request had empty host")
+	}
+
+	req.Command = SocksCmdConnect
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req.AddrType = SocksAddrIPv4
+			req.IP = ip4
+		} else {
+			req.AddrType = SocksAddrIPv6
+			req.IP = ip
+		}
+		req.Host = req.IP.String()
+	} else {
+		req.AddrType = SocksAddrDomainName
+		req.Host = host
+	}
+	req.Port = int(port)
+	req.Target = net.JoinHostPort(req.Host, portStr)
+
+	if auth := httpReq.Header.Get("Proxy-Authorization"); auth != "" {
+		if req.Username, req.Password, err = httpParseBasicAuth(auth); err != nil {
+			return &SocksHandshakeError{Kind: SocksErrMalformed, Err: err}
+		}
+	}
+	// Mash the username/password together and parse it as a pluggable
+	// transport argument string, as for SOCKS.
+	if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
+		return &SocksHandshakeError{Kind: SocksErrBadArgs, Err: err}
+	}
+	return nil
+}
+
+// Return the username and password from the value of an Authorization or
+// Proxy-Authorization header that uses the Basic scheme. The credentials are
+// split at the first colon not escaped by a backslash.
+func httpParseBasicAuth(auth string) (username, password string, err error) {
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		err = fmt.Errorf("Proxy-Authorization header does not use the Basic scheme")
+		return
+	}
+	var creds []byte
+	if creds, err = base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):])); err != nil {
+		return
+	}
+	i := 0
+	for ; i < len(creds) && creds[i] != ':'; i++ {
+		if creds[i] == '\\' {
+			i++
+		}
+	}
+	if i >= len(creds) {
+		err = fmt.Errorf("Proxy-Authorization credentials lack a colon")
+		return
+	}
+	username, password = string(creds[:i]), string(creds[i+1:])
+	return
+}
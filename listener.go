@@ -0,0 +1,261 @@
+package pt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// TrackedListener wraps a net.Listener, keeping count of the connections it
+// has accepted that are not yet closed, so that a transport can shut down
+// gracefully: stop accepting new connections, give the existing ones time to
+// finish, and then close whatever is left.
+//
+// To track the connections of a SocksListener, put the TrackedListener
+// underneath it:
+// 	ln, err := net.Listen("tcp", "127.0.0.1:0")
+// 	if err != nil {
+// 		return err
+// 	}
+// 	tracked := pt.NewTrackedListener(ln)
+// 	socksLn := pt.NewSocksListener(tracked)
+// 	...
+// 	<-drain.Done()
+// 	tracked.Shutdown(exit)
+type TrackedListener struct {
+	net.Listener
+	// If not nil, Shutdown reports progress with Controller.Log rather than
+	// the package-level Log.
+	Controller *Controller
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+	// Non-nil once Shutdown has been called; closed when the last
+	// connection is closed after that.
+	idle chan struct{}
+}
+
+// Return a TrackedListener that accepts connections from ln.
+func NewTrackedListener(ln net.Listener) *TrackedListener {
+	return &TrackedListener{
+		Listener: ln,
+		conns:    make(map[*trackedConn]struct{}),
+	}
+}
+
+// Accept a connection and start tracking it. The connection stops being
+// tracked when it is closed.
+func (ln *TrackedListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := &trackedConn{Conn: c, ln: ln}
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.idle != nil {
+		// Accepted at the same time as Shutdown closed the listener.
+		c.Close()
+		return nil, &net.OpError{Op: "accept", Net: ln.Addr().Network(), Addr: ln.Addr(), Err: net.ErrClosed}
+	}
+	ln.conns[conn] = struct{}{}
+	return conn, nil
+}
+
+// Return the number of accepted connections that have not yet been closed.
+func (ln *TrackedListener) ActiveConns() int {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	return len(ln.conns)
+}
+
+// Stop tracking conn.
+func (ln *TrackedListener) remove(conn *trackedConn) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if _, ok := ln.conns[conn]; !ok {
+		return
+	}
+	delete(ln.conns, conn)
+	if ln.idle != nil && len(ln.conns) == 0 {
+		close(ln.idle)
+	}
+}
+
+// Close the listener so that no new connections are accepted, then wait for
+// the active connections to be closed, or for ctx to be done, whichever comes
+// first. When ctx is done, any connections still active are closed forcibly
+// and ctx.Err() is returned. Progress is reported using Log, or ln.Controller
+// if it is set.
+func (ln *TrackedListener) Shutdown(ctx context.Context) error {
+	err := ln.Listener.Close()
+
+	ln.mu.Lock()
+	if ln.idle == nil {
+		ln.idle = make(chan struct{})
+		if len(ln.conns) == 0 {
+			close(ln.idle)
+		}
+	}
+	idle := ln.idle
+	n := len(ln.conns)
+	ln.mu.Unlock()
+
+	if n > 0 {
+		ln.log(LogSeverityNotice, fmt.Sprintf("%s: shutting down; waiting for %d active connections", ln.Addr(), n))
+	}
+	select {
+	case <-idle:
+		if n > 0 {
+			ln.log(LogSeverityNotice, fmt.Sprintf("%s: all connections finished", ln.Addr()))
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	ln.mu.Lock()
+	conns := make([]*trackedConn, 0, len(ln.conns))
+	for conn := range ln.conns {
+		conns = append(conns, conn)
+	}
+	ln.mu.Unlock()
+	if len(conns) > 0 {
+		ln.log(LogSeverityWarning, fmt.Sprintf("%s: closing %d connections that did not finish", ln.Addr(), len(conns)))
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return ctx.Err()
+}
+
+// Emit a LOG message on ln.Controller, or with Log if it is nil.
+func (ln *TrackedListener) log(severity logSeverity, message string) {
+	if ln.Controller != nil {
+		ln.Controller.Log(severity, message)
+	} else {
+		Log(severity, message)
+	}
+}
+
+// A connection accepted by a TrackedListener.
+type trackedConn struct {
+	net.Conn
+	ln *TrackedListener
+}
+
+func (conn *trackedConn) Close() error {
+	conn.ln.remove(conn)
+	return conn.Conn.Close()
+}
+
+// handshakeLoop accepts connections from a net.Listener and runs a handshake
+// on each one in its own goroutine, a limited number at a time, so that a slow
+// client does not hold up the others. Handshakes are delivered in the order in
+// which they complete. The loop starts on the first call to init.
+type handshakeLoop struct {
+	initOnce  sync.Once
+	closeOnce sync.Once
+	// Completed handshakes and temporary Accept errors.
+	results chan handshakeResult
+	// Closed when the loop stops because of a permanent error, which is
+	// then in err.
+	done chan struct{}
+	err  error
+	// Closed by close.
+	closed chan struct{}
+}
+
+// The outcome of accepting one connection.
+type handshakeResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Start the loop, the first time this is called. handshake is called on each
+// accepted connection, at most max at a time; it is responsible for closing
+// the connection if it returns an error, in which case the connection is
+// dropped.
+func (l *handshakeLoop) init(ln net.Listener, max int, handshake func(net.Conn) (net.Conn, error)) {
+	l.initOnce.Do(func() {
+		l.results = make(chan handshakeResult)
+		l.done = make(chan struct{})
+		l.closed = make(chan struct{})
+		go l.run(ln, max, handshake)
+	})
+}
+
+// Return the next completed handshake or temporary error, or the permanent
+// error that stopped the loop.
+func (l *handshakeLoop) accept() (net.Conn, error) {
+	select {
+	case r := <-l.results:
+		return r.conn, r.err
+	case <-l.done:
+		// The loop has stopped, but there may still be a completed
+		// handshake waiting.
+		select {
+		case r := <-l.results:
+			return r.conn, r.err
+		default:
+		}
+		return nil, l.err
+	}
+}
+
+// Stop delivering handshakes. Those that complete afterwards are closed. The
+// caller should also close the net.Listener, which stops the loop. The loop
+// calls this itself when Accept returns a permanent error.
+func (l *handshakeLoop) close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+func (l *handshakeLoop) run(ln net.Listener, max int, handshake func(net.Conn) (net.Conn, error)) {
+	sem := make(chan struct{}, max)
+	for {
+		// Once the listener is closed, stop waiting for a free slot and
+		// let Accept return the error.
+		held := false
+		select {
+		case sem <- struct{}{}:
+			held = true
+		case <-l.closed:
+		}
+		release := func() {
+			if held {
+				<-sem
+			}
+		}
+		c, err := ln.Accept()
+		if err != nil {
+			release()
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				select {
+				case l.results <- handshakeResult{err: err}:
+				case <-l.closed:
+				}
+				continue
+			}
+			// Nobody may call close, for example if the wrapped
+			// listener was closed directly, so stop delivering
+			// handshakes here; those in progress are closed as
+			// they finish.
+			l.close()
+			l.err = err
+			close(l.done)
+			return
+		}
+		go func() {
+			defer release()
+			conn, err := handshake(c)
+			if err != nil {
+				return
+			}
+			select {
+			case l.results <- handshakeResult{conn: conn}:
+			case <-l.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
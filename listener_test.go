@@ -0,0 +1,187 @@
+package pt
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Accept n connections from ln, which is a listener on the loopback interface,
+// returning the server and client sides.
+func acceptTracked(t *testing.T, ln *TrackedListener, n int) (servers, clients []net.Conn) {
+	for i := 0; i < n; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+		clients = append(clients, client)
+	}
+	return
+}
+
+func newTestTrackedListener(t *testing.T) *TrackedListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTrackedListener(ln)
+}
+
+func TestTrackedListenerActiveConns(t *testing.T) {
+	ln := newTestTrackedListener(t)
+	defer ln.Close()
+
+	servers, clients := acceptTracked(t, ln, 3)
+	for _, c := range clients {
+		defer c.Close()
+	}
+	if n := ln.ActiveConns(); n != 3 {
+		t.Errorf("ActiveConns → %d (expected 3)", n)
+	}
+	servers[0].Close()
+	// A second Close must not count twice.
+	servers[0].Close()
+	if n := ln.ActiveConns(); n != 2 {
+		t.Errorf("ActiveConns → %d (expected 2)", n)
+	}
+	servers[1].Close()
+	servers[2].Close()
+	if n := ln.ActiveConns(); n != 0 {
+		t.Errorf("ActiveConns → %d (expected 0)", n)
+	}
+}
+
+func TestTrackedListenerShutdownDrain(t *testing.T) {
+	Stdout = ioutil.Discard
+
+	ln := newTestTrackedListener(t)
+	servers, clients := acceptTracked(t, ln, 2)
+	for _, c := range clients {
+		defer c.Close()
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
+	err := ln.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Shutdown unexpectedly returned an error: %s", err)
+	}
+	if n := ln.ActiveConns(); n != 0 {
+		t.Errorf("ActiveConns after Shutdown → %d (expected 0)", n)
+	}
+	// The listener no longer accepts connections.
+	_, err = ln.Accept()
+	if err == nil {
+		t.Errorf("Accept after Shutdown unexpectedly succeeded")
+	}
+}
+
+func TestTrackedListenerShutdownDeadline(t *testing.T) {
+	Stdout = ioutil.Discard
+
+	ln := newTestTrackedListener(t)
+	_, clients := acceptTracked(t, ln, 2)
+	for _, c := range clients {
+		defer c.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ln.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v (expected %v)", err, context.DeadlineExceeded)
+	}
+	if n := ln.ActiveConns(); n != 0 {
+		t.Errorf("ActiveConns after Shutdown → %d (expected 0)", n)
+	}
+	// The remaining connections were closed forcibly.
+	for _, c := range clients {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := c.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("client Read after forced close returned %v (expected %v)", err, io.EOF)
+		}
+	}
+}
+
+// TestTrackedListenerController tests that Shutdown reports progress on
+// Controller when it is set, and not on Stdout.
+func TestTrackedListenerController(t *testing.T) {
+	var stdout, buf bytes.Buffer
+	Stdout = &stdout
+	defer func() { Stdout = ioutil.Discard }()
+
+	ln := newTestTrackedListener(t)
+	ln.Controller = NewController(&buf)
+	_, clients := acceptTracked(t, ln, 1)
+	defer clients[0].Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ln.Shutdown(ctx)
+	if stdout.Len() != 0 {
+		t.Errorf("Shutdown wrote %q to Stdout", stdout.String())
+	}
+	if !strings.Contains(buf.String(), "LOG SEVERITY=notice") || !strings.Contains(buf.String(), "LOG SEVERITY=warning") {
+		t.Errorf("Shutdown wrote %q to Controller", buf.String())
+	}
+}
+
+// TestTrackedListenerShutdownSocks tests that a SOCKS handshake that finishes
+// after the TrackedListener beneath a SocksListener is shut down does not
+// keep Shutdown waiting, even though the SocksListener is never closed.
+func TestTrackedListenerShutdownSocks(t *testing.T) {
+	Stdout = ioutil.Discard
+
+	tracked := newTestTrackedListener(t)
+	ln := NewSocksListener(tracked)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := ln.AcceptSocks()
+		errs <- err
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for tracked.ActiveConns() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- tracked.Shutdown(ctx) }()
+	if err := <-errs; err == nil {
+		t.Fatal("AcceptSocks after Shutdown unexpectedly succeeded")
+	}
+
+	// Finish the handshake; the connection is closed instead of being
+	// delivered.
+	c.Write([]byte("\x05\x01\x00"))
+	io.ReadFull(c, make([]byte, 2))
+	c.Write([]byte("\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x01"))
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v (expected nil)", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Errorf("client did not see the connection closed: %v", err)
+	}
+}
@@ -0,0 +1,514 @@
+package pt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dialers for the upstream proxy types that tor may ask for in TOR_PT_PROXY.
+// https://gitweb.torproject.org/torspec.git/tree/proposals/232-pluggable-transports-through-proxy.txt
+
+// Put a sanity timeout on how long we wait for an upstream proxy to complete
+// its handshake.
+const proxyHandshakeTimeout = 30 * time.Second
+
+// SOCKS4a constants. https://www.openssh.com/txt/socks4.protocol and
+// https://www.openssh.com/txt/socks4a.protocol.
+const (
+	socks4Version       = 0x04
+	socks4CmdConnect    = 0x01
+	socks4CmdBind       = 0x02
+	socks4ReplyVersion  = 0x00
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+)
+
+// A ProxyDialerFunc returns a Dialer that makes connections through the
+// upstream proxy at proxyURL, using forward to connect to the proxy itself.
+type ProxyDialerFunc func(proxyURL *url.URL, forward Dialer) (Dialer, error)
+
+// Registered proxy schemes, mapping a lowercase URL scheme to a
+// ProxyDialerFunc. Initially contains the schemes that tor uses in
+// TOR_PT_PROXY.
+var proxySchemes = struct {
+	sync.Mutex
+	m map[string]ProxyDialerFunc
+}{m: map[string]ProxyDialerFunc{
+	"http": func(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+		return &httpProxyDialer{proxyURL, forward}, nil
+	},
+	"socks5": func(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+		return &socks5ProxyDialer{proxyURL, forward}, nil
+	},
+	"socks4a": func(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+		return &socks4aProxyDialer{proxyURL, forward}, nil
+	},
+}}
+
+// Register f to make Dialers for upstream proxy URLs having the given scheme.
+// ClientInfo.ProxyDialer and NewProxyDialer consult the registered schemes, so
+// call this before them. Registering a scheme that is already registered,
+// including one of the built-in "http", "socks5", and "socks4a", replaces the
+// previous ProxyDialerFunc. Registering a nil f removes the scheme.
+//
+// 	func dialCorp(proxyURL *url.URL, forward pt.Dialer) (pt.Dialer, error) {
+// 		...
+// 	}
+// 	...
+// 	pt.RegisterProxyScheme("corp", dialCorp)
+// 	...
+// 	dialer, err := ptInfo.ProxyDialer()
+func RegisterProxyScheme(scheme string, f ProxyDialerFunc) {
+	scheme = strings.ToLower(scheme)
+	proxySchemes.Lock()
+	defer proxySchemes.Unlock()
+	if f == nil {
+		delete(proxySchemes.m, scheme)
+	} else {
+		proxySchemes.m[scheme] = f
+	}
+}
+
+// Return the sorted list of registered proxy schemes.
+func registeredProxySchemes() []string {
+	proxySchemes.Lock()
+	defer proxySchemes.Unlock()
+	schemes := make([]string, 0, len(proxySchemes.m))
+	for scheme := range proxySchemes.m {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Return a Dialer that makes connections through the upstream proxy at
+// proxyURL, using the ProxyDialerFunc registered for its scheme. The built-in
+// schemes are those that tor uses in TOR_PT_PROXY: "http" (HTTP CONNECT, with
+// Basic authentication if the URL has userinfo), "socks5" (with RFC 1929
+// authentication if the URL has userinfo), and "socks4a" (sending the URL's
+// username, if any, as the userid). Connections to the proxy itself are made
+// using forward; if forward is nil, a zero net.Dialer is used. Returns an error
+// if the scheme is not registered.
+func NewProxyDialer(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	scheme := strings.ToLower(proxyURL.Scheme)
+	proxySchemes.Lock()
+	f := proxySchemes.m[scheme]
+	proxySchemes.Unlock()
+	if f == nil {
+		return nil, fmt.Errorf("proxy scheme %q is not supported (supported schemes: %s)",
+			scheme, strings.Join(registeredProxySchemes(), ", "))
+	}
+	return f(proxyURL, forward)
+}
+
+// The state behind ClientInfo.ProxyDialer: the Controller on which to report
+// the outcome, and the outcome, which is computed only once.
+type clientProxy struct {
+	c      *Controller
+	once   sync.Once
+	dialer Dialer
+	err    error
+}
+
+// Guards the setting of ClientInfo.proxy in a ClientInfo that was not
+// returned by ClientSetup.
+var clientProxyMu sync.Mutex
+
+// Return a Dialer that makes connections through the upstream proxy in
+// info.ProxyURL, using info.OutboundDialer to reach the proxy, and tell tor
+// whether the proxy can be used: emit a PROXY DONE line if the scheme of
+// info.ProxyURL has been registered with RegisterProxyScheme (the schemes
+// "http", "socks5", and "socks4a" are registered by default), or else a
+// PROXY-ERROR line, and return a non-nil error. If info.ProxyURL is nil,
+// returns info.OutboundDialer and emits nothing. The line is emitted on the
+// Controller whose ClientSetup returned info (or with the package-level
+// functions, if info was not returned by ClientSetup), and only on the first
+// call; later calls return the same results.
+//
+// ClientSetup does not emit PROXY lines itself. A transport that handles
+// info.ProxyURL on its own should call ProxyDone or ProxyError instead of
+// this method, not as well as it.
+//
+// 	dialer, err := ptInfo.ProxyDialer()
+// 	if err != nil {
+// 		os.Exit(1)
+// 	}
+// 	...
+// 	remote, err := dialer.Dial("tcp", conn.Req.Target)
+func (info *ClientInfo) ProxyDialer() (Dialer, error) {
+	clientProxyMu.Lock()
+	if info.proxy == nil {
+		// Not from ClientSetup; use the package-level functions.
+		info.proxy = &clientProxy{c: defaultController}
+	}
+	p := info.proxy
+	clientProxyMu.Unlock()
+	p.once.Do(func() {
+		p.dialer, p.err = p.c.proxyDialer(info)
+	})
+	return p.dialer, p.err
+}
+
+// Do the work of ClientInfo.ProxyDialer, emitting lines on c.
+func (c *Controller) proxyDialer(info *ClientInfo) (Dialer, error) {
+	forward := info.OutboundDialer()
+	if info.ProxyURL == nil {
+		return forward, nil
+	}
+	dialer, err := NewProxyDialer(info.ProxyURL, forward)
+	if err != nil {
+		return nil, c.proxyErrorCause(err.Error(), err)
+	}
+	err = c.ProxyDone()
+	if err != nil {
+		return nil, err
+	}
+	return dialer, nil
+}
+
+// Returns an error unless network is one that a proxy can dial.
+func proxyCheckNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+}
+
+// Split a "host:port" address into a host and a numeric port.
+func proxySplitAddr(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// Dial the proxy with forward, set a deadline, and run handshake on the
+// resulting connection. Closes the connection and returns an error if any step
+// fails.
+func proxyDial(forward Dialer, proxyURL *url.URL, handshake func(net.Conn) (net.Conn, error)) (net.Conn, error) {
+	conn, err := forward.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// A net.Conn whose reads come from a bufio.Reader, for when a handshake may
+// have buffered data past its end.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type httpProxyDialer struct {
+	proxyURL *url.URL
+	forward  Dialer
+}
+
+// Connect to address using the HTTP CONNECT method.
+func (d *httpProxyDialer) Dial(network, address string) (net.Conn, error) {
+	if err := proxyCheckNetwork(network); err != nil {
+		return nil, err
+	}
+	return proxyDial(d.forward, d.proxyURL, func(conn net.Conn) (net.Conn, error) {
+		return httpProxyHandshake(conn, address, d.proxyURL.User)
+	})
+}
+
+// Send a CONNECT request for address and read the response. The returned
+// net.Conn includes any data the proxy sent after its response header. Returns
+// an error, without sending anything, if address is not a valid "host:port"
+// string; in particular, it may not contain spaces or control characters,
+// which could otherwise inject headers or requests.
+func httpProxyHandshake(conn net.Conn, address string, user *url.Userinfo) (net.Conn, error) {
+	if err := httpCheckAuthority(address); err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: address},
+		Host:   address,
+		// An empty User-Agent suppresses the default one.
+		Header: http.Header{"User-Agent": []string{""}},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	// Request.Write also validates the Host header.
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy returned status %q", resp.Status)
+	}
+	return &bufferedConn{conn, br}, nil
+}
+
+// Returns an error unless address is a "host:port" string whose host contains
+// only printable ASCII characters other than space.
+func httpCheckAuthority(address string) error {
+	host, _, err := proxySplitAddr(address)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] <= ' ' || host[i] >= 0x7f {
+			return fmt.Errorf("CONNECT host %q contains a forbidden byte", host)
+		}
+	}
+	return nil
+}
+
+type socks5ProxyDialer struct {
+	proxyURL *url.URL
+	forward  Dialer
+}
+
+// Connect to address using a SOCKS5 CONNECT command.
+func (d *socks5ProxyDialer) Dial(network, address string) (net.Conn, error) {
+	if err := proxyCheckNetwork(network); err != nil {
+		return nil, err
+	}
+	host, port, err := proxySplitAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return proxyDial(d.forward, d.proxyURL, func(conn net.Conn) (net.Conn, error) {
+		return conn, socks5ClientHandshake(conn, host, port, d.proxyURL.User)
+	})
+}
+
+// Conduct a SOCKS5 CONNECT handshake, as a client, for host and port. If user
+// is not nil, RFC 1929 username/password authentication is offered in
+// addition to no authentication.
+func socks5ClientHandshake(rw io.ReadWriter, host string, port int, user *url.Userinfo) error {
+	// Encode the address first so as not to send anything if it's bad.
+	addr, err := socksEncodeAddr(host, port)
+	if err != nil {
+		return err
+	}
+
+	// Negotiate the authentication method.
+	methods := []byte{SocksAuthNoneRequired}
+	if user != nil {
+		methods = append(methods, SocksAuthUsernamePassword)
+	}
+	if err = socks5ClientNegotiateAuth(rw, methods, user); err != nil {
+		return err
+	}
+
+	return socks5ClientConnect(rw, addr)
+}
+
+// Offer the given authentication methods and authenticate with the one the
+// server picks. user is used for SocksAuthUsernamePassword.
+func socks5ClientNegotiateAuth(rw io.ReadWriter, methods []byte, user *url.Userinfo) error {
+	msg := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion {
+		return fmt.Errorf("SOCKS5 proxy replied with version 0x%02x", resp[0])
+	}
+	if resp[1] == socksAuthNoAcceptableMethods {
+		return fmt.Errorf("SOCKS5 proxy accepted none of our authentication methods")
+	}
+	if bytes.IndexByte(methods, resp[1]) == -1 {
+		return fmt.Errorf("SOCKS5 proxy picked an unsupported authentication method 0x%02x", resp[1])
+	}
+	if resp[1] == SocksAuthUsernamePassword {
+		return socks5ClientAuthRFC1929(rw, user)
+	}
+	return nil
+}
+
+// Send a CONNECT command for the encoded address addr and read the reply. If
+// the reply has a failure code, the error is a *SocksReplyError.
+func socks5ClientConnect(rw io.ReadWriter, addr []byte) error {
+	msg := append([]byte{socksVersion, SocksCmdConnect, socksRsv}, addr...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+
+	// Read the reply, including BND.ADDR/BND.PORT, which we ignore.
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion {
+		return fmt.Errorf("SOCKS5 proxy replied with version 0x%02x", resp[0])
+	}
+	var addrLen int
+	switch resp[3] {
+	case SocksAddrIPv4:
+		addrLen = net.IPv4len
+	case SocksAddrIPv6:
+		addrLen = net.IPv6len
+	case SocksAddrDomainName:
+		alen := make([]byte, 1)
+		if _, err := io.ReadFull(rw, alen); err != nil {
+			return err
+		}
+		addrLen = int(alen[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unsupported address type 0x%02x", resp[3])
+	}
+	if _, err := io.ReadFull(rw, make([]byte, addrLen+2)); err != nil {
+		return err
+	}
+	if resp[1] != socksRepSucceeded {
+		return &SocksReplyError{Code: resp[1]}
+	}
+	return nil
+}
+
+// Do RFC 1929 username/password authentication as a client.
+func socks5ClientAuthRFC1929(rw io.ReadWriter, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) < 1 || len(username) > 255 {
+		return fmt.Errorf("RFC1929 username has bad length %d", len(username))
+	}
+	if len(password) < 1 || len(password) > 255 {
+		return fmt.Errorf("RFC1929 password has bad length %d", len(password))
+	}
+	msg := []byte{socksAuthRFC1929Ver}
+	msg = append(msg, byte(len(username)))
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socksAuthRFC1929Ver {
+		return fmt.Errorf("RFC1929 reply had version 0x%02x", resp[0])
+	}
+	if resp[1] != socksAuthRFC1929Success {
+		return fmt.Errorf("SOCKS5 proxy rejected our username and password")
+	}
+	return nil
+}
+
+type socks4aProxyDialer struct {
+	proxyURL *url.URL
+	forward  Dialer
+}
+
+// Connect to address using a SOCKS4a CONNECT command.
+func (d *socks4aProxyDialer) Dial(network, address string) (net.Conn, error) {
+	if err := proxyCheckNetwork(network); err != nil {
+		return nil, err
+	}
+	host, port, err := proxySplitAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	var userid string
+	if d.proxyURL.User != nil {
+		userid = d.proxyURL.User.Username()
+	}
+	return proxyDial(d.forward, d.proxyURL, func(conn net.Conn) (net.Conn, error) {
+		return conn, socks4aClientHandshake(conn, host, port, userid)
+	})
+}
+
+// Conduct a SOCKS4a CONNECT handshake, as a client, for host and port. host
+// may be an IPv4 address or a domain name, but not an IPv6 address.
+func socks4aClientHandshake(rw io.ReadWriter, host string, port int, userid string) error {
+	msg := []byte{socks4Version, socks4CmdConnect, byte(port >> 8), byte(port)}
+	var hostname string
+	if ip := net.ParseIP(host); ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return fmt.Errorf("SOCKS4a cannot connect to IPv6 address %s", ip)
+		}
+		msg = append(msg, ip4...)
+	} else {
+		// An address of 0.0.0.x, with x nonzero, means that a host
+		// name follows the userid.
+		msg = append(msg, 0, 0, 0, 1)
+		hostname = host
+	}
+	for _, s := range []string{userid, hostname} {
+		for i := 0; i < len(s); i++ {
+			if s[i] == 0 {
+				return fmt.Errorf("SOCKS4a field %q contains a NUL byte", s)
+			}
+		}
+	}
+	msg = append(msg, userid...)
+	msg = append(msg, 0)
+	if hostname != "" {
+		msg = append(msg, hostname...)
+		msg = append(msg, 0)
+	}
+	if _, err := rw.Write(msg); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks4ReplyVersion {
+		return fmt.Errorf("SOCKS4a proxy replied with version 0x%02x", resp[0])
+	}
+	if resp[1] != socks4ReplyGranted {
+		return fmt.Errorf("SOCKS4a proxy replied with failure code 0x%02x", resp[1])
+	}
+	return nil
+}
@@ -1,6 +1,15 @@
 package pt
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"testing"
 )
@@ -51,7 +60,7 @@ func TestGetProxyURL(t *testing.T) {
 	}
 
 	os.Clearenv()
-	u, err := getProxyURL()
+	u, err := getProxyURL(osEnvironment{})
 	if err != nil {
 		t.Errorf("empty environment unexpectedly returned an error: %s", err)
 	}
@@ -61,7 +70,7 @@ func TestGetProxyURL(t *testing.T) {
 
 	for _, input := range badTests {
 		os.Setenv("TOR_PT_PROXY", input)
-		u, err = getProxyURL()
+		u, err = getProxyURL(osEnvironment{})
 		if err == nil {
 			t.Errorf("TOR_PT_PROXY=%q unexpectedly succeeded and returned %q", input, u)
 		}
@@ -69,7 +78,7 @@ func TestGetProxyURL(t *testing.T) {
 
 	for _, test := range goodTests {
 		os.Setenv("TOR_PT_PROXY", test.input)
-		u, err := getProxyURL()
+		u, err := getProxyURL(osEnvironment{})
 		if err != nil {
 			t.Errorf("TOR_PT_PROXY=%q unexpectedly returned an error: %s", test.input, err)
 		}
@@ -78,3 +87,477 @@ func TestGetProxyURL(t *testing.T) {
 		}
 	}
 }
+
+// Start a stand-in proxy that accepts a single connection, calls handshake on
+// it, and then echoes back whatever it receives. Any error from handshake is
+// sent on the returned channel; nil is sent if it succeeds.
+func startTestProxy(t *testing.T, handshake func(rw *bufio.ReadWriter) error) (net.Listener, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer c.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+		err = handshake(rw)
+		if err == nil {
+			err = rw.Flush()
+		}
+		errChan <- err
+		if err != nil {
+			return
+		}
+		io.Copy(c, rw)
+	}()
+	return ln, errChan
+}
+
+// Read len(expected)/2 bytes and check that they equal the hex string
+// expected.
+func expectHex(r io.Reader, expected string) error {
+	buf := make([]byte, len(expected)/2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if hex.EncodeToString(buf) != expected {
+		return fmt.Errorf("got %x (expected %s)", buf, expected)
+	}
+	return nil
+}
+
+// Dial address through d and check that data is echoed back.
+func checkProxyDialer(t *testing.T, d Dialer, address string, errChan <-chan error) {
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		t.Errorf("Dial(%q) unexpectedly returned an error: %s", address, err)
+		if err := <-errChan; err != nil {
+			t.Errorf("proxy error: %s", err)
+		}
+		return
+	}
+	defer conn.Close()
+	if err := <-errChan; err != nil {
+		t.Errorf("proxy error: %s", err)
+		return
+	}
+	const msg = "hello"
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echo returned %q (expected %q)", buf, msg)
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	ln, errChan := startTestProxy(t, func(rw *bufio.ReadWriter) error {
+		req, err := http.ReadRequest(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if req.Method != "CONNECT" || req.Host != "example.com:1234" {
+			return fmt.Errorf("bad request %s %s", req.Method, req.Host)
+		}
+		auth := req.Header.Get("Proxy-Authorization")
+		if auth != "Basic dXNlcjpwYXNz" {
+			return fmt.Errorf("bad Proxy-Authorization %q", auth)
+		}
+		// Data immediately after the response header must not be
+		// lost.
+		_, err = rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\nearly")
+		return err
+	})
+	defer ln.Close()
+
+	u, _ := url.Parse("http://user:pass@" + ln.Addr().String())
+	d, err := NewProxyDialer(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "example.com:1234")
+	if err != nil {
+		t.Fatalf("Dial unexpectedly returned an error: %s", err)
+	}
+	defer conn.Close()
+	if err := <-errChan; err != nil {
+		t.Fatalf("proxy error: %s", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "early" {
+		t.Errorf("read %q, %v after response header (expected %q)", buf, err, "early")
+	}
+}
+
+func TestHTTPProxyDialerFailure(t *testing.T) {
+	ln, _ := startTestProxy(t, func(rw *bufio.ReadWriter) error {
+		if _, err := http.ReadRequest(rw.Reader); err != nil {
+			return err
+		}
+		_, err := rw.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return err
+	})
+	defer ln.Close()
+
+	u, _ := url.Parse("http://" + ln.Addr().String())
+	d, err := NewProxyDialer(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", "example.com:1234")
+	if err == nil {
+		t.Errorf("Dial unexpectedly succeeded with a 407 response")
+	}
+}
+
+// TestHTTPProxyHandshakeInjection tests that a SOCKS target cannot inject
+// headers or requests into the CONNECT request sent to an upstream proxy.
+func TestHTTPProxyHandshakeInjection(t *testing.T) {
+	domain := "example.com\r\nX-Evil: 1\r\n\r\nGET http://internal/ HTTP/1.1\r\nHost: internal"
+	c := new(testReadWriter)
+	c.writeHex("050100" + "03" + hex.EncodeToString([]byte{byte(len(domain))}) + hex.EncodeToString([]byte(domain)) + "01bb")
+	var req SocksRequest
+	if err := socksReadCommand(c.toBufio(), &req, nil); err != nil {
+		t.Fatal("socksReadCommand failed:", err)
+	}
+
+	for _, address := range []string{
+		req.Target,
+		"example.com :443",
+		"example.com\x00:443",
+		"[::1]:443\r\n",
+	} {
+		rec := new(replyRecorder)
+		if _, err := httpProxyHandshake(rec, address, nil); err == nil {
+			t.Errorf("%q unexpectedly succeeded", address)
+		}
+		if rec.buf.Len() != 0 {
+			t.Errorf("%q sent %q", address, rec.buf.String())
+		}
+	}
+}
+
+func TestSocks5ProxyDialer(t *testing.T) {
+	tests := [...]struct {
+		userinfo string
+		address  string
+		// The bytes we expect from the client, and those we send in
+		// reply, in alternation.
+		exchange []string
+	}{
+		{
+			"",
+			"127.0.0.1:9050",
+			[]string{
+				"050100", "0500",
+				"050100017f000001235a", "05000001000000000000",
+			},
+		},
+		{
+			"user:pass",
+			"example.com:9050",
+			[]string{
+				"05020002", "0502",
+				"0104757365720470617373", "0100",
+				"050100030b6578616d706c652e636f6d235a", "05000004000000000000000000000000000000000000",
+			},
+		},
+		{
+			"",
+			"[1:2::3:4]:9050",
+			[]string{
+				"050100", "0500",
+				"0501000400010002000000000000000000030004235a", "050000030474657374235a",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		exchange := test.exchange
+		ln, errChan := startTestProxy(t, func(rw *bufio.ReadWriter) error {
+			for i := 0; i < len(exchange); i += 2 {
+				if err := expectHex(rw, exchange[i]); err != nil {
+					return err
+				}
+				reply, _ := hex.DecodeString(exchange[i+1])
+				rw.Write(reply)
+				if err := rw.Flush(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		u, _ := url.Parse("socks5://" + ln.Addr().String())
+		if test.userinfo != "" {
+			u, _ = url.Parse("socks5://" + test.userinfo + "@" + ln.Addr().String())
+		}
+		d, err := NewProxyDialer(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkProxyDialer(t, d, test.address, errChan)
+		ln.Close()
+	}
+}
+
+func TestSocks5ProxyDialerFailure(t *testing.T) {
+	ln, _ := startTestProxy(t, func(rw *bufio.ReadWriter) error {
+		if err := expectHex(rw, "050100"); err != nil {
+			return err
+		}
+		rw.Write([]byte{0x05, 0x00})
+		rw.Flush()
+		if err := expectHex(rw, "050100017f000001235a"); err != nil {
+			return err
+		}
+		// Connection refused.
+		_, err := rw.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return err
+	})
+	defer ln.Close()
+
+	u, _ := url.Parse("socks5://" + ln.Addr().String())
+	d, err := NewProxyDialer(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", "127.0.0.1:9050")
+	if err == nil {
+		t.Errorf("Dial unexpectedly succeeded with a failure reply")
+	}
+}
+
+func TestSocks4aProxyDialer(t *testing.T) {
+	tests := [...]struct {
+		userinfo string
+		address  string
+		request  string
+	}{
+		{"", "127.0.0.1:9050", "0401235a7f00000100"},
+		{"user", "127.0.0.1:9050", "0401235a7f0000017573657200"},
+		{"", "example.com:9050", "0401235a00000001006578616d706c652e636f6d00"},
+	}
+
+	for _, test := range tests {
+		request := test.request
+		ln, errChan := startTestProxy(t, func(rw *bufio.ReadWriter) error {
+			if err := expectHex(rw, request); err != nil {
+				return err
+			}
+			_, err := rw.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+			return err
+		})
+		u, _ := url.Parse("socks4a://" + ln.Addr().String())
+		if test.userinfo != "" {
+			u, _ = url.Parse("socks4a://" + test.userinfo + "@" + ln.Addr().String())
+		}
+		d, err := NewProxyDialer(u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkProxyDialer(t, d, test.address, errChan)
+		ln.Close()
+	}
+
+	// SOCKS4a has no way to express an IPv6 address.
+	var buf bytes.Buffer
+	err := socks4aClientHandshake(&buf, "1:2::3:4", 9050, "")
+	if err == nil || buf.Len() != 0 {
+		t.Errorf("IPv6 address unexpectedly succeeded or sent %x", buf.Bytes())
+	}
+}
+
+func TestNewProxyDialerUnsupported(t *testing.T) {
+	for _, rawurl := range []string{
+		"unknown://localhost:9999",
+		"https://localhost:8080",
+		"socks4://localhost:1080",
+	} {
+		u, _ := url.Parse(rawurl)
+		_, err := NewProxyDialer(u, nil)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", rawurl)
+		}
+	}
+}
+
+func TestClientInfoProxyDialer(t *testing.T) {
+	tests := [...]struct {
+		rawurl   string
+		expected string
+		ok       bool
+	}{
+		{"", "", true},
+		{"http://localhost:8080", "PROXY DONE\n", true},
+		{"socks5://localhost:1080", "PROXY DONE\n", true},
+		{"socks4a://localhost:1080", "PROXY DONE\n", true},
+		{"unknown://localhost:9999", "PROXY-ERROR proxy scheme \"unknown\" is not supported (supported schemes: http, socks4a, socks5)\n", false},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c := newTestController(&buf, roleClient)
+		info := ClientInfo{proxy: &clientProxy{c: c}}
+		if test.rawurl != "" {
+			info.ProxyURL, _ = url.Parse(test.rawurl)
+		}
+		d, err := info.ProxyDialer()
+		if test.ok && (err != nil || d == nil) {
+			t.Errorf("%q unexpectedly returned an error: %v", test.rawurl, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q unexpectedly succeeded", test.rawurl)
+		}
+		// A second call emits nothing more and returns the same
+		// results.
+		d2, err2 := info.ProxyDialer()
+		if d2 != d || err2 != err {
+			t.Errorf("%q: second call → %v, %v (expected %v, %v)", test.rawurl, d2, err2, d, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%q → %q (expected %q)", test.rawurl, buf.String(), test.expected)
+		}
+	}
+}
+
+// TestClientInfoProxyDialerDefault tests that ProxyDialer, on a ClientInfo
+// that was not returned by ClientSetup, emits PROXY DONE only once.
+func TestClientInfoProxyDialerDefault(t *testing.T) {
+	var buf bytes.Buffer
+	Stdout = &buf
+	defer func() { Stdout = ioutil.Discard }()
+
+	defaultController.begin(roleClient)
+	defaultController.line("VERSION", "1")
+	buf.Reset()
+	info := ClientInfo{}
+	info.ProxyURL, _ = url.Parse("socks5://localhost:1080")
+	d, err := info.ProxyDialer()
+	if err != nil || d == nil {
+		t.Fatalf("unexpectedly returned an error: %v", err)
+	}
+	d2, err2 := info.ProxyDialer()
+	if d2 != d || err2 != nil {
+		t.Errorf("second call → %v, %v (expected %v, %v)", d2, err2, d, nil)
+	}
+	if buf.String() != "PROXY DONE\n" {
+		t.Errorf("→ %q (expected %q)", buf.String(), "PROXY DONE\n")
+	}
+}
+
+// A Dialer that records the address it was asked to dial.
+type recordingDialer struct {
+	proxyURL *url.URL
+	forward  Dialer
+	address  string
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	d.address = address
+	return nil, fmt.Errorf("not really dialing")
+}
+
+func TestRegisterProxyScheme(t *testing.T) {
+	defer func() { Stdout = ioutil.Discard }()
+
+	var registered *recordingDialer
+	RegisterProxyScheme("Corp", func(proxyURL *url.URL, forward Dialer) (Dialer, error) {
+		registered = &recordingDialer{proxyURL: proxyURL, forward: forward}
+		return registered, nil
+	})
+	defer RegisterProxyScheme("corp", nil)
+
+	os.Clearenv()
+	os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	os.Setenv("TOR_PT_CLIENT_TRANSPORTS", "alpha")
+	os.Setenv("TOR_PT_OUTBOUND_BIND_ADDRESS_V4", "127.0.0.1")
+	os.Setenv("TOR_PT_PROXY", "corp://user@localhost:3128")
+	var buf bytes.Buffer
+	Stdout = &buf
+	info, err := ClientSetup(nil)
+	if err != nil {
+		t.Fatalf("ClientSetup unexpectedly returned an error: %s", err)
+	}
+	if buf.String() != "VERSION 1\n" {
+		t.Errorf("ClientSetup emitted %q", buf.String())
+	}
+	dialer, err := info.ProxyDialer()
+	if err != nil {
+		t.Fatalf("ProxyDialer unexpectedly returned an error: %s", err)
+	}
+	if buf.String() != "VERSION 1\nPROXY DONE\n" {
+		t.Errorf("ProxyDialer emitted %q", buf.String())
+	}
+	if registered == nil || dialer != Dialer(registered) {
+		t.Fatalf("ProxyDialer did not use the registered ProxyDialerFunc: %#v", dialer)
+	}
+	if registered.proxyURL.String() != "corp://user@localhost:3128" {
+		t.Errorf("ProxyDialerFunc got URL %q", registered.proxyURL)
+	}
+	forward, ok := registered.forward.(*OutboundDialer)
+	if !ok || forward.BindAddrV4 == nil || !forward.BindAddrV4.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("ProxyDialerFunc got forward Dialer %#v", registered.forward)
+	}
+	dialer.Dial("tcp", "example.com:1234")
+	if registered.address != "example.com:1234" {
+		t.Errorf("Dialer got address %q", registered.address)
+	}
+
+	// After unregistering, the scheme is an error.
+	RegisterProxyScheme("corp", nil)
+	buf.Reset()
+	info, err = ClientSetup(nil)
+	if err != nil {
+		t.Fatalf("ClientSetup unexpectedly returned an error: %s", err)
+	}
+	_, err = info.ProxyDialer()
+	if err == nil {
+		t.Errorf("ProxyDialer with unregistered scheme unexpectedly succeeded")
+	}
+	if buf.String() != "VERSION 1\nPROXY-ERROR proxy scheme \"corp\" is not supported (supported schemes: http, socks4a, socks5)\n" {
+		t.Errorf("ProxyDialer emitted %q", buf.String())
+	}
+
+	// A transport that interprets ProxyURL itself and calls ProxyDone, as
+	// before ProxyDialer existed, emits PROXY DONE exactly once.
+	buf.Reset()
+	info, err = ClientSetup(nil)
+	if err != nil {
+		t.Fatalf("ClientSetup unexpectedly returned an error: %s", err)
+	}
+	if info.ProxyURL == nil {
+		t.Fatal("ClientSetup did not set ProxyURL")
+	}
+	if err := ProxyDone(); err != nil {
+		t.Errorf("ProxyDone unexpectedly returned an error: %s", err)
+	}
+	if buf.String() != "VERSION 1\nPROXY DONE\n" {
+		t.Errorf("ClientSetup and ProxyDone emitted %q", buf.String())
+	}
+
+	// Without TOR_PT_PROXY, ProxyDialer returns an OutboundDialer.
+	os.Unsetenv("TOR_PT_PROXY")
+	buf.Reset()
+	info, err = ClientSetup(nil)
+	if err != nil {
+		t.Fatalf("ClientSetup unexpectedly returned an error: %s", err)
+	}
+	dialer, err = info.ProxyDialer()
+	if err != nil {
+		t.Fatalf("ProxyDialer unexpectedly returned an error: %s", err)
+	}
+	if buf.String() != "VERSION 1\n" {
+		t.Errorf("ClientSetup and ProxyDialer emitted %q", buf.String())
+	}
+	if _, ok := dialer.(*OutboundDialer); !ok {
+		t.Errorf("ProxyDialer without a proxy returned %#v", dialer)
+	}
+}
@@ -1,17 +1,17 @@
 // Package pt implements the Tor pluggable transports specification.
 //
 // Sample client usage:
-// 	var ptInfo pt.ClientInfo
+// 	var dialer pt.Dialer
 // 	...
 // 	func handler(conn *pt.SocksConn) error {
 // 		defer conn.Close()
-// 		remote, err := net.Dial("tcp", conn.Req.Target)
+// 		remote, err := dialer.Dial("tcp", conn.Req.Target)
 // 		if err != nil {
-// 			conn.Reject()
+// 			conn.RejectError(err)
 // 			return err
 // 		}
 // 		defer remote.Close()
-// 		err = conn.Grant(remote.RemoteAddr().(*net.TCPAddr))
+// 		err = conn.GrantAddr(remote.LocalAddr())
 // 		if err != nil {
 // 			return err
 // 		}
@@ -35,15 +35,14 @@
 // 	}
 // 	...
 // 	func main() {
-// 		var err error
-// 		ptInfo, err = pt.ClientSetup(nil)
+// 		ptInfo, err := pt.ClientSetup(nil)
 // 		if err != nil {
 // 			os.Exit(1)
 // 		}
-// 		if ptInfo.ProxyURL != nil {
-// 			// you need to interpret the proxy URL yourself
-// 			// call pt.ProxyDone instead if it's a type you understand
-// 			pt.ProxyError(fmt.Sprintf("proxy %s is not supported", ptInfo.ProxyURL))
+// 		// Emits PROXY DONE, or PROXY-ERROR if tor asked for a proxy
+// 		// whose scheme is not supported.
+// 		dialer, err = ptInfo.ProxyDialer()
+// 		if err != nil {
 // 			os.Exit(1)
 // 		}
 // 		for _, methodName := range ptInfo.MethodNames {
@@ -144,11 +143,13 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -186,30 +187,113 @@ func (w syncWriter) Write(p []byte) (n int, err error) {
 // 	}
 // and then redefining Stdout:
 // 	pt.Stdout = logWriteWrapper{pt.Stdout}
+//
+// Stdout is used only by the package-level functions. A Controller created with
+// NewController writes to its own Writer instead.
 var Stdout io.Writer = syncWriter{os.Stdout}
 
+// Sentinel errors that match a ProtocolError with the corresponding keyword
+// when used with errors.Is:
+// 	_, err := pt.ServerSetup(nil)
+// 	if errors.Is(err, pt.ErrVersion) {
+// 		// tor asked for a protocol version we don't understand.
+// 	}
+var (
+	ErrEnv     = errors.New("ENV-ERROR")
+	ErrVersion = errors.New("VERSION-ERROR")
+	ErrCmethod = errors.New("CMETHOD-ERROR")
+	ErrSmethod = errors.New("SMETHOD-ERROR")
+	ErrProxy   = errors.New("PROXY-ERROR")
+)
+
 // Represents an error that can happen during negotiation, for example
 // ENV-ERROR. When an error occurs, we print it to stdout and also pass it up
-// the return chain.
-type ptErr struct {
+// the return chain as a *ProtocolError. Use errors.As to get at the fields, or
+// errors.Is with one of the sentinels such as ErrEnv to check the keyword.
+type ProtocolError struct {
+	// The keyword of the line that was emitted, for example "ENV-ERROR".
 	Keyword string
-	Args    []string
+	// The method name, for CMETHOD-ERROR and SMETHOD-ERROR; otherwise "".
+	MethodName string
+	// The explanation text.
+	Msg string
+	// The error that caused this one, if any; for example the error from
+	// resolving an address in an environment variable.
+	Err error
 }
 
-// Implements the error interface.
-func (err *ptErr) Error() string {
-	return formatline(err.Keyword, err.Args...)
+// Return the args of the line that represents err.
+func (err *ProtocolError) args() []string {
+	switch err.Keyword {
+	case "CMETHOD-ERROR", "SMETHOD-ERROR":
+		return []string{err.MethodName, err.Msg}
+	default:
+		return []string{err.Msg}
+	}
 }
 
-func getenv(key string) string {
+// Implements the error interface. The string is the same as the line that was
+// emitted.
+func (err *ProtocolError) Error() string {
+	return formatline(err.Keyword, err.args()...)
+}
+
+// Return the underlying cause, if any.
+func (err *ProtocolError) Unwrap() error {
+	return err.Err
+}
+
+// Report whether target is the sentinel error for err's keyword.
+func (err *ProtocolError) Is(target error) bool {
+	switch target {
+	case ErrEnv:
+		return err.Keyword == "ENV-ERROR"
+	case ErrVersion:
+		return err.Keyword == "VERSION-ERROR"
+	case ErrCmethod:
+		return err.Keyword == "CMETHOD-ERROR"
+	case ErrSmethod:
+		return err.Keyword == "SMETHOD-ERROR"
+	case ErrProxy:
+		return err.Keyword == "PROXY-ERROR"
+	}
+	return false
+}
+
+// An Environment is a source of pluggable transports environment variables,
+// such as TOR_PT_MANAGED_TRANSPORT_VER. ClientSetup and ServerSetup read the
+// process environment; ClientSetupEnv and ServerSetupEnv read an Environment,
+// which may be an EnvMap or your own implementation.
+type Environment interface {
+	// Return the value of the variable named by key, or "" if it is not
+	// set.
+	Getenv(key string) string
+}
+
+// EnvMap is an Environment backed by a map from variable names to values.
+type EnvMap map[string]string
+
+// Return env[key].
+func (env EnvMap) Getenv(key string) string {
+	return env[key]
+}
+
+// The process environment, as an Environment.
+type osEnvironment struct{}
+
+func (osEnvironment) Getenv(key string) string {
 	return os.Getenv(key)
 }
 
+func getenv(env Environment, key string) string {
+	return env.Getenv(key)
+}
+
 // Returns an ENV-ERROR if the environment variable isn't set.
-func getenvRequired(key string) (string, error) {
-	value := os.Getenv(key)
+func (c *Controller) getenvRequired(env Environment, key string) (string, error) {
+	value := env.Getenv(key)
 	if value == "" {
-		return "", envError(fmt.Sprintf("no %s environment variable", key))
+		return "", c.envError(fmt.Sprintf("no %s environment variable", key))
 	}
 	return value, nil
 }
@@ -261,63 +345,43 @@ func formatline(keyword string, v ...string) string {
 	return buf.String()
 }
 
-// Print a pluggable transports protocol line to Stdout. The line consists of a
-// keyword followed by any number of space-separated arg strings. Panics if
-// there are forbidden bytes in the keyword or the args (pt-spec.txt 2.2.1).
-func line(keyword string, v ...string) {
-	fmt.Fprintln(Stdout, formatline(keyword, v...))
-}
-
-// Emit and return the given error as a ptErr.
-func doError(keyword string, v ...string) *ptErr {
-	line(keyword, v...)
-	return &ptErr{keyword, v}
-}
-
-// Emit an ENV-ERROR line with explanation text. Returns a representation of the
-// error.
-func envError(msg string) error {
-	return doError("ENV-ERROR", msg)
-}
-
-// Emit a VERSION-ERROR line with explanation text. Returns a representation of
-// the error.
-func versionError(msg string) error {
-	return doError("VERSION-ERROR", msg)
-}
-
 // Emit a CMETHOD-ERROR line with explanation text. Returns a representation of
-// the error.
+// the error, a *ProtocolError.
 func CmethodError(methodName, msg string) error {
-	return doError("CMETHOD-ERROR", methodName, msg)
+	return defaultController.CmethodError(methodName, msg)
 }
 
 // Emit an SMETHOD-ERROR line with explanation text. Returns a representation of
-// the error.
+// the error, a *ProtocolError.
 func SmethodError(methodName, msg string) error {
-	return doError("SMETHOD-ERROR", methodName, msg)
+	return defaultController.SmethodError(methodName, msg)
 }
 
 // Emit a PROXY-ERROR line with explanation text. Returns a representation of
-// the error.
+// the error, a *ProtocolError.
 func ProxyError(msg string) error {
-	return doError("PROXY-ERROR", msg)
+	return defaultController.ProxyError(msg)
 }
 
 // Emit a CMETHOD line. socks must be "socks4" or "socks5". Call this once for
-// each listening client SOCKS port.
-func Cmethod(name string, socks string, addr net.Addr) {
-	line("CMETHOD", name, socks, addr.String())
+// each listening client SOCKS port. Returns an error wrapping ErrBadSequence if
+// called before ClientSetup or after CmethodsDone; the line is emitted anyway.
+func Cmethod(name string, socks string, addr net.Addr) error {
+	return defaultController.Cmethod(name, socks, addr)
 }
 
 // Emit a CMETHODS DONE line. Call this after opening all client listeners.
-func CmethodsDone() {
-	line("CMETHODS", "DONE")
+// Returns an error wrapping ErrBadSequence if the line is out of sequence, for
+// example if CmethodsDone was already called; the line is emitted anyway.
+func CmethodsDone() error {
+	return defaultController.CmethodsDone()
 }
 
-// Emit an SMETHOD line. Call this once for each listening server port.
-func Smethod(name string, addr net.Addr) {
-	line("SMETHOD", name, addr.String())
+// Emit an SMETHOD line. Call this once for each listening server port. Returns
+// an error wrapping ErrBadSequence if called before ServerSetup or after
+// SmethodsDone; the line is emitted anyway.
+func Smethod(name string, addr net.Addr) error {
+	return defaultController.Smethod(name, addr)
 }
 
 // Emit an SMETHOD line with an ARGS option. args is a name–value mapping that
@@ -335,18 +399,23 @@ func Smethod(name string, addr net.Addr) {
 // Or, if you just want to echo back the options provided by Tor from the
 // TransportServerOptions configuration,
 // 	pt.SmethodArgs(bindaddr.MethodName, ln.Addr(), bindaddr.Options)
-func SmethodArgs(name string, addr net.Addr, args Args) {
-	line("SMETHOD", name, addr.String(), "ARGS:"+encodeSmethodArgs(args))
+func SmethodArgs(name string, addr net.Addr, args Args) error {
+	return defaultController.SmethodArgs(name, addr, args)
 }
 
 // Emit an SMETHODS DONE line. Call this after opening all server listeners.
-func SmethodsDone() {
-	line("SMETHODS", "DONE")
+// Returns an error wrapping ErrBadSequence if the line is out of sequence, for
+// example if SmethodsDone was already called; the line is emitted anyway.
+func SmethodsDone() error {
+	return defaultController.SmethodsDone()
 }
 
-// Emit a PROXY DONE line. Call this after parsing ClientInfo.ProxyURL.
-func ProxyDone() {
-	fmt.Fprintf(Stdout, "PROXY DONE\n")
+// Emit a PROXY DONE line. Call this after parsing ClientInfo.ProxyURL, unless
+// you use ClientInfo.ProxyDialer, which calls it for you. Returns an error
+// wrapping ErrBadSequence if PROXY DONE was already emitted or if a CMETHOD line
+// has been emitted; the line is emitted anyway.
+func ProxyDone() error {
+	return defaultController.ProxyDone()
 }
 
 // Unexported type to represent log severities, preventing external callers from
@@ -388,7 +457,8 @@ var (
 // but it is an error in the spec: https://bugs.torproject.org/29432.
 //
 // We additionally need to ensure that whatever we return passes argIsSafe,
-// because strings encoded by this function are printed verbatim by Log.
+// because strings encoded by this function are printed verbatim by Log and
+// Status.
 func encodeCString(s string) string {
 	result := bytes.NewBuffer([]byte{})
 	result.WriteByte('"')
@@ -406,18 +476,56 @@ func encodeCString(s string) string {
 // Emit a LOG message with the given severity (one of LogSeverityError,
 // LogSeverityWarning, LogSeverityNotice, LogSeverityInfo, or LogSeverityDebug).
 func Log(severity logSeverity, message string) {
-	// "<Message> contains the log message which can be a String or CString..."
-	// encodeCString always makes the string safe to emit; i.e., it
-	// satisfies argIsSafe.
-	line("LOG", "SEVERITY="+severity.string, "MESSAGE="+encodeCString(message))
+	defaultController.Log(severity, message)
+}
+
+// Return the args of a STATUS line for the given transport and key–value
+// pairs. Keys are emitted in sorted order, one key=value pair for each value,
+// with values encoded as CStrings. Panics if methodName or any of the keys
+// are empty or contain anything but the bytes allowed in a keyword, or if a
+// key is "TRANSPORT".
+func formatStatusArgs(methodName string, kv Args) []string {
+	if methodName == "" || !keywordIsSafe(methodName) {
+		panic(fmt.Sprintf("method name %q contains forbidden bytes", methodName))
+	}
+	keys := make([]string, 0, len(kv))
+	for key := range kv {
+		if key == "" || !keywordIsSafe(key) {
+			panic(fmt.Sprintf("key %q contains forbidden bytes", key))
+		}
+		if key == "TRANSPORT" {
+			panic("key \"TRANSPORT\" is reserved")
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{"TRANSPORT=" + methodName}
+	for _, key := range keys {
+		for _, value := range kv[key] {
+			args = append(args, key+"="+encodeCString(value))
+		}
+	}
+	return args
+}
+
+// Emit a STATUS message reporting the state of the transport methodName, for
+// tor to pass on to its controllers (pt-spec.txt section 3.3.5). Each value in
+// kv is quoted, so it may contain any bytes. The keys must contain only
+// US-ASCII alphanumerics, dashes, and underscores; Status panics otherwise.
+// 	args := pt.Args{}
+// 	args.Add("ADDRESS", remote.String())
+// 	args.Add("CONNECT", "Success")
+// 	pt.Status(methodName, args)
+func Status(methodName string, kv Args) {
+	defaultController.Status(methodName, kv)
 }
 
 // Get a pluggable transports version offered by Tor and understood by us, if
 // any. The only version we understand is "1". This function reads the
 // environment variable TOR_PT_MANAGED_TRANSPORT_VER.
-func getManagedTransportVer() (string, error) {
+func (c *Controller) getManagedTransportVer(env Environment) (string, error) {
 	const transportVersion = "1"
-	managedTransportVer, err := getenvRequired("TOR_PT_MANAGED_TRANSPORT_VER")
+	managedTransportVer, err := c.getenvRequired(env, "TOR_PT_MANAGED_TRANSPORT_VER")
 	if err != nil {
 		return "", err
 	}
@@ -426,7 +534,7 @@ func getManagedTransportVer() (string, error) {
 			return offered, nil
 		}
 	}
-	return "", versionError("no-version")
+	return "", c.versionError("no-version")
 }
 
 // Return the directory name in the TOR_PT_STATE_LOCATION environment variable,
@@ -434,7 +542,7 @@ func getManagedTransportVer() (string, error) {
 // TOR_PT_STATE_LOCATION is not set or if there is an error creating the
 // directory.
 func MakeStateDir() (string, error) {
-	dir, err := getenvRequired("TOR_PT_STATE_LOCATION")
+	dir, err := defaultController.getenvRequired(osEnvironment{}, "TOR_PT_STATE_LOCATION")
 	if err != nil {
 		return "", err
 	}
@@ -444,8 +552,8 @@ func MakeStateDir() (string, error) {
 
 // Get the list of method names requested by Tor. This function reads the
 // environment variable TOR_PT_CLIENT_TRANSPORTS.
-func getClientTransports() ([]string, error) {
-	clientTransports, err := getenvRequired("TOR_PT_CLIENT_TRANSPORTS")
+func (c *Controller) getClientTransports(env Environment) ([]string, error) {
+	clientTransports, err := c.getenvRequired(env, "TOR_PT_CLIENT_TRANSPORTS")
 	if err != nil {
 		return nil, err
 	}
@@ -460,9 +568,10 @@ func getClientTransports() ([]string, error) {
 // This function doesn't check that the scheme is one of Tor's supported proxy
 // schemes; that is, one of "http", "socks5", or "socks4a". The caller must be
 // able to handle any returned scheme (which may be by calling ProxyError if
-// it doesn't know how to handle the scheme).
-func getProxyURL() (*url.URL, error) {
-	rawurl := os.Getenv("TOR_PT_PROXY")
+// it doesn't know how to handle the scheme). ClientInfo.ProxyDialer does this,
+// using the schemes registered with RegisterProxyScheme.
+func getProxyURL(env Environment) (*url.URL, error) {
+	rawurl := getenv(env, "TOR_PT_PROXY")
 	if rawurl == "" {
 		return nil, nil
 	}
@@ -489,17 +598,55 @@ func getProxyURL() (*url.URL, error) {
 	return u, nil
 }
 
+// Get the local addresses from which outgoing connections should be made.
+// Either return value is nil if the corresponding variable is not set. This
+// function reads the environment variables TOR_PT_OUTBOUND_BIND_ADDRESS_V4 and
+// TOR_PT_OUTBOUND_BIND_ADDRESS_V6.
+func (c *Controller) getOutboundBindAddrs(env Environment) (v4, v6 *net.TCPAddr, err error) {
+	bindAddrV4 := getenv(env, "TOR_PT_OUTBOUND_BIND_ADDRESS_V4")
+	if bindAddrV4 != "" {
+		v4, err = resolveBindAddr(bindAddrV4, false)
+		if err != nil {
+			return nil, nil, c.envErrorCause(fmt.Sprintf("cannot resolve TOR_PT_OUTBOUND_BIND_ADDRESS_V4 %q: %s", bindAddrV4, err.Error()), err)
+		}
+	}
+	bindAddrV6 := getenv(env, "TOR_PT_OUTBOUND_BIND_ADDRESS_V6")
+	if bindAddrV6 != "" {
+		v6, err = resolveBindAddr(bindAddrV6, true)
+		if err != nil {
+			return nil, nil, c.envErrorCause(fmt.Sprintf("cannot resolve TOR_PT_OUTBOUND_BIND_ADDRESS_V6 %q: %s", bindAddrV6, err.Error()), err)
+		}
+	}
+	return v4, v6, nil
+}
+
 // This structure is returned by ClientSetup. It consists of a list of method
-// names and the upstream proxy URL, if any.
+// names, the upstream proxy URL, if any, the local addresses to use for
+// outgoing connections, if any. Use ProxyDialer to get a Dialer that takes all
+// of these into account.
 type ClientInfo struct {
 	MethodNames []string
 	ProxyURL    *url.URL
+	// Addresses from TOR_PT_OUTBOUND_BIND_ADDRESS_V4 and
+	// TOR_PT_OUTBOUND_BIND_ADDRESS_V6, with a Port of 0. nil if tor did not
+	// request a bind address for the address family. Use OutboundDialer to
+	// make connections that respect them.
+	OutboundBindAddrV4 *net.TCPAddr
+	OutboundBindAddrV6 *net.TCPAddr
+
+	proxy *clientProxy
 }
 
 // Check the client pluggable transports environment, emitting an error message
 // and returning a non-nil error if any error is encountered. Returns a
 // ClientInfo struct.
 //
+// If tor requests an upstream proxy in TOR_PT_PROXY, its URL is in
+// info.ProxyURL. ClientSetup does not tell tor whether the proxy is supported;
+// either call info.ProxyDialer, which emits PROXY DONE or PROXY-ERROR according
+// to the schemes registered with RegisterProxyScheme, or interpret the URL
+// yourself and call ProxyDone or ProxyError.
+//
 // If your program needs to know whether to call ClientSetup or ServerSetup
 // (i.e., if the same program can be run as either a client or a server), check
 // whether the TOR_PT_CLIENT_TRANSPORTS environment variable is set:
@@ -515,21 +662,52 @@ type ClientInfo struct {
 // specification.
 // https://bugs.torproject.org/15612
 func ClientSetup(_ []string) (info ClientInfo, err error) {
-	ver, err := getManagedTransportVer()
+	return ClientSetupEnv(osEnvironment{})
+}
+
+// Like ClientSetup, but reads the pluggable transports environment variables
+// from env rather than from the process environment. Validation and the lines
+// emitted are the same as for ClientSetup.
+//
+// 	info, err := pt.ClientSetupEnv(pt.EnvMap{
+// 		"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+// 		"TOR_PT_CLIENT_TRANSPORTS":     "foo",
+// 	})
+func ClientSetupEnv(env Environment) (info ClientInfo, err error) {
+	return defaultController.ClientSetup(env)
+}
+
+// Like ClientSetupEnv, but emits lines on c. If env is nil, the pluggable
+// transports environment variables are read from the process environment.
+// Calling ClientSetup starts a new client handshake on c, forgetting which
+// lines were emitted before.
+func (c *Controller) ClientSetup(env Environment) (info ClientInfo, err error) {
+	if env == nil {
+		env = osEnvironment{}
+	}
+	c.begin(roleClient)
+
+	ver, err := c.getManagedTransportVer(env)
+	if err != nil {
+		return
+	}
+	c.line("VERSION", ver)
+
+	info.MethodNames, err = c.getClientTransports(env)
 	if err != nil {
 		return
 	}
-	line("VERSION", ver)
 
-	info.MethodNames, err = getClientTransports()
+	info.OutboundBindAddrV4, info.OutboundBindAddrV6, err = c.getOutboundBindAddrs(env)
 	if err != nil {
 		return
 	}
 
-	info.ProxyURL, err = getProxyURL()
+	info.ProxyURL, err = getProxyURL(env)
 	if err != nil {
 		return
 	}
+	info.proxy = &clientProxy{c: c}
 
 	return info, nil
 }
@@ -586,6 +764,26 @@ func resolveAddr(addrStr string) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip, Port: port}, nil
 }
 
+// Resolve an outbound bind address string into a net.TCPAddr with a Port of 0.
+// The string is an IP address without a port, as in
+// TOR_PT_OUTBOUND_BIND_ADDRESS_V4 and TOR_PT_OUTBOUND_BIND_ADDRESS_V6; IPv6
+// addresses may be enclosed in brackets. The address must belong to the address
+// family selected by ipv6.
+func resolveBindAddr(addrStr string, ipv6 bool) (*net.TCPAddr, error) {
+	// Add a dummy port so that the same syntax rules as resolveAddr apply.
+	addr, err := resolveAddr(addrStr + ":0")
+	if err != nil {
+		return nil, err
+	}
+	if ipv6 && addr.IP.To4() != nil {
+		return nil, net.InvalidAddrError(fmt.Sprintf("not an IPv6 address: %q", addrStr))
+	}
+	if !ipv6 && addr.IP.To4() == nil {
+		return nil, net.InvalidAddrError(fmt.Sprintf("not an IPv4 address: %q", addrStr))
+	}
+	return addr, nil
+}
+
 // Return a new slice, the members of which are those members of addrs having a
 // MethodName in methodNames.
 func filterBindaddrs(addrs []Bindaddr, methodNames []string) []Bindaddr {
@@ -606,18 +804,18 @@ func filterBindaddrs(addrs []Bindaddr, methodNames []string) []Bindaddr {
 // Return an array of Bindaddrs, being the contents of TOR_PT_SERVER_BINDADDR
 // with keys filtered by TOR_PT_SERVER_TRANSPORTS. Transport-specific options
 // from TOR_PT_SERVER_TRANSPORT_OPTIONS are assigned to the Options member.
-func getServerBindaddrs() ([]Bindaddr, error) {
+func (c *Controller) getServerBindaddrs(env Environment) ([]Bindaddr, error) {
 	var result []Bindaddr
 
 	// Parse the list of server transport options.
-	serverTransportOptions := getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS")
+	serverTransportOptions := getenv(env, "TOR_PT_SERVER_TRANSPORT_OPTIONS")
 	optionsMap, err := parseServerTransportOptions(serverTransportOptions)
 	if err != nil {
-		return nil, envError(fmt.Sprintf("TOR_PT_SERVER_TRANSPORT_OPTIONS: %q: %s", serverTransportOptions, err.Error()))
+		return nil, c.envErrorCause(fmt.Sprintf("TOR_PT_SERVER_TRANSPORT_OPTIONS: %q: %s", serverTransportOptions, err.Error()), err)
 	}
 
 	// Get the list of all requested bindaddrs.
-	serverBindaddr, err := getenvRequired("TOR_PT_SERVER_BINDADDR")
+	serverBindaddr, err := c.getenvRequired(env, "TOR_PT_SERVER_BINDADDR")
 	if err != nil {
 		return nil, err
 	}
@@ -627,18 +825,18 @@ func getServerBindaddrs() ([]Bindaddr, error) {
 
 		parts := strings.SplitN(spec, "-", 2)
 		if len(parts) != 2 {
-			return nil, envError(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: doesn't contain \"-\"", spec))
+			return nil, c.envError(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: doesn't contain \"-\"", spec))
 		}
 		bindaddr.MethodName = parts[0]
 		// Check for duplicate method names: "Applications MUST NOT set
 		// more than one <address>:<port> pair per PT name."
 		if seenMethods[bindaddr.MethodName] {
-			return nil, envError(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: duplicate method name %q", spec, bindaddr.MethodName))
+			return nil, c.envError(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: duplicate method name %q", spec, bindaddr.MethodName))
 		}
 		seenMethods[bindaddr.MethodName] = true
 		addr, err := resolveAddr(parts[1])
 		if err != nil {
-			return nil, envError(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: %s", spec, err.Error()))
+			return nil, c.envErrorCause(fmt.Sprintf("TOR_PT_SERVER_BINDADDR: %q: %s", spec, err.Error()), err)
 		}
 		bindaddr.Addr = addr
 		bindaddr.Options = optionsMap[bindaddr.MethodName]
@@ -646,7 +844,7 @@ func getServerBindaddrs() ([]Bindaddr, error) {
 	}
 
 	// Filter by TOR_PT_SERVER_TRANSPORTS.
-	serverTransports, err := getenvRequired("TOR_PT_SERVER_TRANSPORTS")
+	serverTransports, err := c.getenvRequired(env, "TOR_PT_SERVER_TRANSPORTS")
 	if err != nil {
 		return nil, err
 	}
@@ -726,44 +924,64 @@ type ServerInfo struct {
 // specification.
 // https://bugs.torproject.org/15612
 func ServerSetup(_ []string) (info ServerInfo, err error) {
-	ver, err := getManagedTransportVer()
+	return ServerSetupEnv(osEnvironment{})
+}
+
+// Like ServerSetup, but reads the pluggable transports environment variables
+// from env rather than from the process environment. Validation and the lines
+// emitted are the same as for ServerSetup.
+func ServerSetupEnv(env Environment) (info ServerInfo, err error) {
+	return defaultController.ServerSetup(env)
+}
+
+// Like ServerSetupEnv, but emits lines on c. If env is nil, the pluggable
+// transports environment variables are read from the process environment.
+// Calling ServerSetup starts a new server handshake on c, forgetting which
+// lines were emitted before.
+func (c *Controller) ServerSetup(env Environment) (info ServerInfo, err error) {
+	if env == nil {
+		env = osEnvironment{}
+	}
+	c.begin(roleServer)
+
+	ver, err := c.getManagedTransportVer(env)
 	if err != nil {
 		return
 	}
-	line("VERSION", ver)
+	c.line("VERSION", ver)
 
-	info.Bindaddrs, err = getServerBindaddrs()
+	info.Bindaddrs, err = c.getServerBindaddrs(env)
 	if err != nil {
 		return
 	}
 
-	orPort := getenv("TOR_PT_ORPORT")
+	orPort := getenv(env, "TOR_PT_ORPORT")
 	if orPort != "" {
 		info.OrAddr, err = resolveAddr(orPort)
 		if err != nil {
-			err = envError(fmt.Sprintf("cannot resolve TOR_PT_ORPORT %q: %s", orPort, err.Error()))
+			err = c.envErrorCause(fmt.Sprintf("cannot resolve TOR_PT_ORPORT %q: %s", orPort, err.Error()), err)
 			return
 		}
 	}
 
-	info.AuthCookiePath = getenv("TOR_PT_AUTH_COOKIE_FILE")
+	info.AuthCookiePath = getenv(env, "TOR_PT_AUTH_COOKIE_FILE")
 
-	extendedOrPort := getenv("TOR_PT_EXTENDED_SERVER_PORT")
+	extendedOrPort := getenv(env, "TOR_PT_EXTENDED_SERVER_PORT")
 	if extendedOrPort != "" {
 		if info.AuthCookiePath == "" {
-			err = envError("need TOR_PT_AUTH_COOKIE_FILE environment variable with TOR_PT_EXTENDED_SERVER_PORT")
+			err = c.envError("need TOR_PT_AUTH_COOKIE_FILE environment variable with TOR_PT_EXTENDED_SERVER_PORT")
 			return
 		}
 		info.ExtendedOrAddr, err = resolveAddr(extendedOrPort)
 		if err != nil {
-			err = envError(fmt.Sprintf("cannot resolve TOR_PT_EXTENDED_SERVER_PORT %q: %s", extendedOrPort, err.Error()))
+			err = c.envErrorCause(fmt.Sprintf("cannot resolve TOR_PT_EXTENDED_SERVER_PORT %q: %s", extendedOrPort, err.Error()), err)
 			return
 		}
 	}
 
 	// Need either OrAddr or ExtendedOrAddr.
 	if info.OrAddr == nil && info.ExtendedOrAddr == nil {
-		err = envError("need TOR_PT_ORPORT or TOR_PT_EXTENDED_SERVER_PORT environment variable")
+		err = c.envError("need TOR_PT_ORPORT or TOR_PT_EXTENDED_SERVER_PORT environment variable")
 		return
 	}
 
@@ -3,6 +3,7 @@ package pt
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,25 +21,51 @@ func TestErrors(t *testing.T) {
 	Stdout = ioutil.Discard
 
 	var err error
-	err = envError("XYZ")
+	err = NewController(ioutil.Discard).envError("XYZ")
 	if err.Error() != "ENV-ERROR XYZ" {
 		t.Errorf("unexpected string %q from envError", err.Error())
 	}
-	err = versionError("XYZ")
+	err = NewController(ioutil.Discard).versionError("XYZ")
 	if err.Error() != "VERSION-ERROR XYZ" {
 		t.Errorf("unexpected string %q from versionError", err.Error())
 	}
+
+	var buf bytes.Buffer
+	Stdout = &buf
+	defer func() { Stdout = ioutil.Discard }()
+
+	defaultController.begin(roleClient)
+	defaultController.line("VERSION", "1")
 	err = CmethodError("method", "XYZ")
-	if err.Error() != "CMETHOD-ERROR method XYZ" {
-		t.Errorf("unexpected string %q from CmethodError", err.Error())
+	if err.Error() != "CMETHOD-ERROR method XYZ" || !errors.Is(err, ErrCmethod) {
+		t.Errorf("unexpected error %q from CmethodError", err)
 	}
+	defaultController.begin(roleServer)
+	defaultController.line("VERSION", "1")
 	err = SmethodError("method", "XYZ")
-	if err.Error() != "SMETHOD-ERROR method XYZ" {
-		t.Errorf("unexpected string %q from SmethodError", err.Error())
+	if err.Error() != "SMETHOD-ERROR method XYZ" || !errors.Is(err, ErrSmethod) {
+		t.Errorf("unexpected error %q from SmethodError", err)
 	}
+	defaultController.begin(roleClient)
+	defaultController.line("VERSION", "1")
 	err = ProxyError("XYZ")
-	if err.Error() != "PROXY-ERROR XYZ" {
-		t.Errorf("unexpected string %q from ProxyError", err.Error())
+	if err.Error() != "PROXY-ERROR XYZ" || !errors.Is(err, ErrProxy) {
+		t.Errorf("unexpected error %q from ProxyError", err)
+	}
+	expected := "VERSION 1\nCMETHOD-ERROR method XYZ\nVERSION 1\nSMETHOD-ERROR method XYZ\nVERSION 1\nPROXY-ERROR XYZ\n"
+	if buf.String() != expected {
+		t.Errorf("wrote %q (expected %q)", buf.String(), expected)
+	}
+
+	// Out of sequence, the line is still emitted and the same error is
+	// returned, as before sequences were checked.
+	buf.Reset()
+	err = CmethodError("method", "XYZ")
+	if err.Error() != "CMETHOD-ERROR method XYZ" || !errors.Is(err, ErrCmethod) {
+		t.Errorf("unexpected error %q from out-of-sequence CmethodError", err)
+	}
+	if buf.String() != "CMETHOD-ERROR method XYZ\n" {
+		t.Errorf("out-of-sequence CmethodError wrote %q", buf.String())
 	}
 }
 
@@ -117,14 +144,14 @@ func TestGetManagedTransportVer(t *testing.T) {
 	Stdout = ioutil.Discard
 
 	os.Clearenv()
-	_, err := getManagedTransportVer()
+	_, err := NewController(ioutil.Discard).getManagedTransportVer(osEnvironment{})
 	if err == nil {
 		t.Errorf("empty environment unexpectedly succeeded")
 	}
 
 	for _, input := range badTests {
 		os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", input)
-		_, err := getManagedTransportVer()
+		_, err := NewController(ioutil.Discard).getManagedTransportVer(osEnvironment{})
 		if err == nil {
 			t.Errorf("TOR_PT_MANAGED_TRANSPORT_VER=%q unexpectedly succeeded", input)
 		}
@@ -132,7 +159,7 @@ func TestGetManagedTransportVer(t *testing.T) {
 
 	for _, test := range goodTests {
 		os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", test.input)
-		output, err := getManagedTransportVer()
+		output, err := NewController(ioutil.Discard).getManagedTransportVer(osEnvironment{})
 		if err != nil {
 			t.Errorf("TOR_PT_MANAGED_TRANSPORT_VER=%q unexpectedly returned an error: %s", test.input, err)
 		}
@@ -204,14 +231,14 @@ func TestGetClientTransports(t *testing.T) {
 	Stdout = ioutil.Discard
 
 	os.Clearenv()
-	_, err := getClientTransports()
+	_, err := NewController(ioutil.Discard).getClientTransports(osEnvironment{})
 	if err == nil {
 		t.Errorf("empty environment unexpectedly succeeded")
 	}
 
 	for _, test := range tests {
 		os.Setenv("TOR_PT_CLIENT_TRANSPORTS", test.ptClientTransports)
-		output, err := getClientTransports()
+		output, err := NewController(ioutil.Discard).getClientTransports(osEnvironment{})
 		if err != nil {
 			t.Errorf("TOR_PT_CLIENT_TRANSPORTS=%q unexpectedly returned an error: %s",
 				test.ptClientTransports, err)
@@ -273,6 +300,68 @@ func TestResolveAddr(t *testing.T) {
 	}
 }
 
+func TestGetOutboundBindAddrs(t *testing.T) {
+	badTests := [...]struct {
+		v4, v6 string
+	}{
+		{"1.2.3.4:9999", ""},
+		{"localhost", ""},
+		{"1:2::3:4", ""},
+		{"", "1.2.3.4"},
+		{"", "[1:2::3:4]:9999"},
+		{"", "[1::2::3:4]"},
+		{"", "localhost"},
+		{"1.2.3.4", "bogus"},
+	}
+	goodTests := [...]struct {
+		v4, v6                 string
+		expectedV4, expectedV6 net.IP
+	}{
+		{"", "", nil, nil},
+		{"1.2.3.4", "", net.ParseIP("1.2.3.4"), nil},
+		{"", "[1:2::3:4]", nil, net.ParseIP("1:2::3:4")},
+		{"", "1:2::3:4", nil, net.ParseIP("1:2::3:4")},
+		{"1.2.3.4", "[1:2::3:4]", net.ParseIP("1.2.3.4"), net.ParseIP("1:2::3:4")},
+	}
+
+	Stdout = ioutil.Discard
+
+	for _, test := range badTests {
+		os.Clearenv()
+		os.Setenv("TOR_PT_OUTBOUND_BIND_ADDRESS_V4", test.v4)
+		os.Setenv("TOR_PT_OUTBOUND_BIND_ADDRESS_V6", test.v6)
+		_, _, err := NewController(ioutil.Discard).getOutboundBindAddrs(osEnvironment{})
+		if err == nil {
+			t.Errorf("TOR_PT_OUTBOUND_BIND_ADDRESS_V4=%q TOR_PT_OUTBOUND_BIND_ADDRESS_V6=%q unexpectedly succeeded",
+				test.v4, test.v6)
+		}
+	}
+
+	for _, test := range goodTests {
+		os.Clearenv()
+		os.Setenv("TOR_PT_OUTBOUND_BIND_ADDRESS_V4", test.v4)
+		os.Setenv("TOR_PT_OUTBOUND_BIND_ADDRESS_V6", test.v6)
+		v4, v6, err := NewController(ioutil.Discard).getOutboundBindAddrs(osEnvironment{})
+		if err != nil {
+			t.Errorf("TOR_PT_OUTBOUND_BIND_ADDRESS_V4=%q TOR_PT_OUTBOUND_BIND_ADDRESS_V6=%q unexpectedly returned an error: %s",
+				test.v4, test.v6, err)
+			continue
+		}
+		for _, x := range []struct {
+			addr     *net.TCPAddr
+			expected net.IP
+		}{{v4, test.expectedV4}, {v6, test.expectedV6}} {
+			if x.expected == nil && x.addr != nil {
+				t.Errorf("TOR_PT_OUTBOUND_BIND_ADDRESS_V4=%q TOR_PT_OUTBOUND_BIND_ADDRESS_V6=%q → %s (expected nil)",
+					test.v4, test.v6, x.addr)
+			} else if x.expected != nil && (x.addr == nil || !tcpAddrsEqual(x.addr, &net.TCPAddr{IP: x.expected})) {
+				t.Errorf("TOR_PT_OUTBOUND_BIND_ADDRESS_V4=%q TOR_PT_OUTBOUND_BIND_ADDRESS_V6=%q → %s (expected %s)",
+					test.v4, test.v6, x.addr, x.expected)
+			}
+		}
+	}
+}
+
 func bindaddrSliceContains(s []Bindaddr, v Bindaddr) bool {
 	for _, sv := range s {
 		if sv.MethodName == v.MethodName && tcpAddrsEqual(sv.Addr, v.Addr) {
@@ -397,7 +486,7 @@ func TestGetServerBindaddrs(t *testing.T) {
 	Stdout = ioutil.Discard
 
 	os.Clearenv()
-	_, err := getServerBindaddrs()
+	_, err := NewController(ioutil.Discard).getServerBindaddrs(osEnvironment{})
 	if err == nil {
 		t.Errorf("empty environment unexpectedly succeeded")
 	}
@@ -406,7 +495,7 @@ func TestGetServerBindaddrs(t *testing.T) {
 		os.Setenv("TOR_PT_SERVER_BINDADDR", test.ptServerBindaddr)
 		os.Setenv("TOR_PT_SERVER_TRANSPORTS", test.ptServerTransports)
 		os.Setenv("TOR_PT_SERVER_TRANSPORT_OPTIONS", test.ptServerTransportOptions)
-		_, err := getServerBindaddrs()
+		_, err := NewController(ioutil.Discard).getServerBindaddrs(osEnvironment{})
 		if err == nil {
 			t.Errorf("TOR_PT_SERVER_BINDADDR=%q TOR_PT_SERVER_TRANSPORTS=%q TOR_PT_SERVER_TRANSPORT_OPTIONS=%q unexpectedly succeeded",
 				test.ptServerBindaddr, test.ptServerTransports, test.ptServerTransportOptions)
@@ -417,7 +506,7 @@ func TestGetServerBindaddrs(t *testing.T) {
 		os.Setenv("TOR_PT_SERVER_BINDADDR", test.ptServerBindaddr)
 		os.Setenv("TOR_PT_SERVER_TRANSPORTS", test.ptServerTransports)
 		os.Setenv("TOR_PT_SERVER_TRANSPORT_OPTIONS", test.ptServerTransportOptions)
-		output, err := getServerBindaddrs()
+		output, err := NewController(ioutil.Discard).getServerBindaddrs(osEnvironment{})
 		if err != nil {
 			t.Errorf("TOR_PT_SERVER_BINDADDR=%q TOR_PT_SERVER_TRANSPORTS=%q TOR_PT_SERVER_TRANSPORT_OPTIONS=%q unexpectedly returned an error: %s",
 				test.ptServerBindaddr, test.ptServerTransports, test.ptServerTransportOptions, err)
@@ -429,6 +518,59 @@ func TestGetServerBindaddrs(t *testing.T) {
 	}
 }
 
+// Check that ClientSetupEnv and ServerSetupEnv with an EnvMap behave the same
+// as ClientSetup and ServerSetup with the same variables in the process
+// environment.
+func TestSetupEnv(t *testing.T) {
+	defer func() { Stdout = ioutil.Discard }()
+
+	tests := [...]EnvMap{
+		{},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "2"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_CLIENT_TRANSPORTS": "alpha,beta"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_CLIENT_TRANSPORTS": "alpha", "TOR_PT_PROXY": "socks5://localhost:1080"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_CLIENT_TRANSPORTS": "alpha", "TOR_PT_PROXY": "unknown://localhost:1080"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_CLIENT_TRANSPORTS": "alpha", "TOR_PT_OUTBOUND_BIND_ADDRESS_V4": "bogus"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_SERVER_BINDADDR": "alpha-1.2.3.4:1111", "TOR_PT_SERVER_TRANSPORTS": "alpha"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_SERVER_BINDADDR": "alpha-1.2.3.4:1111", "TOR_PT_SERVER_TRANSPORTS": "alpha", "TOR_PT_ORPORT": "127.0.0.1:9001"},
+		{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_SERVER_BINDADDR": "alpha-1.2.3.4:1111", "TOR_PT_SERVER_TRANSPORTS": "alpha", "TOR_PT_EXTENDED_SERVER_PORT": "127.0.0.1:6669"},
+	}
+
+	for _, env := range tests {
+		var osBuf, envBuf bytes.Buffer
+		os.Clearenv()
+		for key, value := range env {
+			os.Setenv(key, value)
+		}
+
+		Stdout = &osBuf
+		osClientInfo, osClientErr := ClientSetup(nil)
+		Stdout = &envBuf
+		envClientInfo, envClientErr := ClientSetupEnv(env)
+		if (osClientErr == nil) != (envClientErr == nil) ||
+			fmt.Sprint(osClientInfo.MethodNames, osClientInfo.ProxyURL) != fmt.Sprint(envClientInfo.MethodNames, envClientInfo.ProxyURL) {
+			t.Errorf("%q: ClientSetup → %v, %v; ClientSetupEnv → %v, %v",
+				env, osClientInfo, osClientErr, envClientInfo, envClientErr)
+		}
+
+		Stdout = &osBuf
+		osServerInfo, osServerErr := ServerSetup(nil)
+		Stdout = &envBuf
+		envServerInfo, envServerErr := ServerSetupEnv(env)
+		if (osServerErr == nil) != (envServerErr == nil) ||
+			fmt.Sprint(osServerInfo) != fmt.Sprint(envServerInfo) {
+			t.Errorf("%q: ServerSetup → %v, %v; ServerSetupEnv → %v, %v",
+				env, osServerInfo, osServerErr, envServerInfo, envServerErr)
+		}
+
+		if osBuf.String() != envBuf.String() {
+			t.Errorf("%q: process environment emitted %q; EnvMap emitted %q",
+				env, osBuf.String(), envBuf.String())
+		}
+	}
+}
+
 func TestReadAuthCookie(t *testing.T) {
 	badTests := [...][]byte{
 		[]byte(""),
@@ -1087,3 +1229,97 @@ func TestEncodeCString(t *testing.T) {
 		}
 	}
 }
+
+func TestStatus(t *testing.T) {
+	defer func() { Stdout = ioutil.Discard }()
+
+	tests := [...]struct {
+		methodName string
+		kv         Args
+		expected   string
+	}{
+		{"foo", Args{}, "STATUS TRANSPORT=foo\n"},
+		{"foo", Args{"CONNECT": []string{"Success"}}, "STATUS TRANSPORT=foo CONNECT=\"Success\"\n"},
+		{"foo", Args{"b": []string{"x y"}, "a": []string{"1", "2"}}, "STATUS TRANSPORT=foo a=\"1\" a=\"2\" b=\"x y\"\n"},
+		{"foo", Args{"MSG": []string{"\"quoted\"\n\x00\xff"}}, "STATUS TRANSPORT=foo MSG=\"\\042quoted\\042\\012\\000\\377\"\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		Stdout = &buf
+		Status(test.methodName, test.kv)
+		if buf.String() != test.expected {
+			t.Errorf("%q %q → %q (expected %q)", test.methodName, test.kv, buf.String(), test.expected)
+		}
+	}
+
+	badTests := [...]struct {
+		methodName string
+		kv         Args
+	}{
+		{"", Args{}},
+		{"foo bar", Args{}},
+		{"foo\n", Args{}},
+		{"foo", Args{"": []string{"x"}}},
+		{"foo", Args{"a=b": []string{"x"}}},
+		{"foo", Args{"a b": []string{"x"}}},
+		{"foo", Args{"a\x00": []string{"x"}}},
+		{"foo", Args{"TRANSPORT": []string{"bar"}}},
+	}
+	for _, test := range badTests {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("%q %q unexpectedly did not panic", test.methodName, test.kv)
+				}
+			}()
+			Status(test.methodName, test.kv)
+		}()
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	Stdout = ioutil.Discard
+
+	sentinels := []error{ErrEnv, ErrVersion, ErrCmethod, ErrSmethod, ErrProxy}
+	tests := [...]struct {
+		err        error
+		sentinel   error
+		keyword    string
+		methodName string
+	}{
+		{NewController(ioutil.Discard).envError("XYZ"), ErrEnv, "ENV-ERROR", ""},
+		{NewController(ioutil.Discard).versionError("XYZ"), ErrVersion, "VERSION-ERROR", ""},
+		{newTestController(ioutil.Discard, roleClient).CmethodError("method", "XYZ"), ErrCmethod, "CMETHOD-ERROR", "method"},
+		{newTestController(ioutil.Discard, roleServer).SmethodError("method", "XYZ"), ErrSmethod, "SMETHOD-ERROR", "method"},
+		{newTestController(ioutil.Discard, roleClient).ProxyError("XYZ"), ErrProxy, "PROXY-ERROR", ""},
+	}
+	for _, test := range tests {
+		var e *ProtocolError
+		if !errors.As(test.err, &e) {
+			t.Errorf("%q is not a *ProtocolError", test.err)
+			continue
+		}
+		if e.Keyword != test.keyword || e.MethodName != test.methodName || e.Msg != "XYZ" {
+			t.Errorf("%q → %+v", test.err, e)
+		}
+		for _, sentinel := range sentinels {
+			if errors.Is(test.err, sentinel) != (sentinel == test.sentinel) {
+				t.Errorf("errors.Is(%q, %q) → %v", test.err, sentinel, !(sentinel == test.sentinel))
+			}
+		}
+	}
+
+	// Errors from resolving addresses are wrapped.
+	os.Clearenv()
+	os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+	os.Setenv("TOR_PT_SERVER_BINDADDR", "alpha-xxx")
+	os.Setenv("TOR_PT_ORPORT", "127.0.0.1:9001")
+	_, err := ServerSetup(nil)
+	if !errors.Is(err, ErrEnv) {
+		t.Errorf("bad TOR_PT_SERVER_BINDADDR: expected ErrEnv, got %v", err)
+	}
+	var e *ProtocolError
+	if !errors.As(err, &e) || e.Err == nil || errors.Unwrap(err) != e.Err {
+		t.Errorf("bad TOR_PT_SERVER_BINDADDR: %v does not wrap the resolve error", err)
+	}
+}
@@ -0,0 +1,85 @@
+package pt
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Return two contexts that tell a transport when to shut down, following the
+// conventions tor uses to stop its pluggable transports. The drain context is
+// done when the transport should stop accepting new connections but let
+// existing ones finish; the exit context is done when the transport should
+// exit immediately. drain is always done by the time exit is.
+//
+// 	- SIGTERM finishes both contexts.
+// 	- The first SIGINT finishes only drain; a second SIGINT finishes exit.
+// 	  tor uses this on relays: the first SIGINT starts a graceful shutdown,
+// 	  and a second one means not to wait any longer.
+// 	- If TOR_PT_EXIT_ON_STDIN_CLOSE=1 is set in the environment, end of
+// 	  file on stdin is treated like SIGTERM
+// 	  (https://bugs.torproject.org/15435).
+//
+// Call stop when the contexts are no longer needed, to stop receiving signals
+// and release resources. Calling stop also finishes both contexts.
+//
+// 	drain, exit, stop := pt.SignalContext(context.Background())
+// 	defer stop()
+// 	<-drain.Done()
+// 	for _, ln := range listeners {
+// 		ln.Close()
+// 	}
+// 	<-exit.Done()
+func SignalContext(parent context.Context) (drain, exit context.Context, stop context.CancelFunc) {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGTERM, os.Interrupt)
+
+	var stdin io.Reader
+	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+		stdin = os.Stdin
+	}
+
+	drain, exit, cancel := watchShutdown(parent, sigChan, stdin)
+	return drain, exit, func() {
+		signal.Stop(sigChan)
+		cancel()
+	}
+}
+
+// Implementation of SignalContext, reading signals from sigChan. If stdin is
+// not nil, it is read until EOF (or error) and then exit is finished.
+func watchShutdown(parent context.Context, sigChan <-chan os.Signal, stdin io.Reader) (drain, exit context.Context, stop context.CancelFunc) {
+	exit, cancelExit := context.WithCancel(parent)
+	drain, cancelDrain := context.WithCancel(exit)
+
+	if stdin != nil {
+		go func() {
+			io.Copy(ioutil.Discard, stdin)
+			cancelExit()
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == os.Interrupt && drain.Err() == nil {
+					cancelDrain()
+					continue
+				}
+				cancelExit()
+				return
+			case <-exit.Done():
+				return
+			}
+		}
+	}()
+
+	return drain, exit, func() {
+		cancelDrain()
+		cancelExit()
+	}
+}
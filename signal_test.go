@@ -0,0 +1,90 @@
+package pt
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Return true iff ctx is done within a short time.
+func isDone(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestWatchShutdownSIGTERM(t *testing.T) {
+	sigChan := make(chan os.Signal, 1)
+	drain, exit, stop := watchShutdown(context.Background(), sigChan, nil)
+	defer stop()
+
+	if isDone(drain) || isDone(exit) {
+		t.Fatal("done before any signal")
+	}
+	sigChan <- syscall.SIGTERM
+	if !isDone(exit) {
+		t.Error("exit not done after SIGTERM")
+	}
+	if !isDone(drain) {
+		t.Error("drain not done after SIGTERM")
+	}
+}
+
+func TestWatchShutdownSIGINT(t *testing.T) {
+	sigChan := make(chan os.Signal, 1)
+	drain, exit, stop := watchShutdown(context.Background(), sigChan, nil)
+	defer stop()
+
+	sigChan <- os.Interrupt
+	if !isDone(drain) {
+		t.Error("drain not done after first SIGINT")
+	}
+	if isDone(exit) {
+		t.Error("exit done after first SIGINT")
+	}
+	sigChan <- os.Interrupt
+	if !isDone(exit) {
+		t.Error("exit not done after second SIGINT")
+	}
+}
+
+func TestWatchShutdownStdin(t *testing.T) {
+	pr, pw := io.Pipe()
+	drain, exit, stop := watchShutdown(context.Background(), make(chan os.Signal), pr)
+	defer stop()
+
+	pw.Write([]byte("data"))
+	if isDone(exit) {
+		t.Error("exit done before stdin EOF")
+	}
+	pw.Close()
+	if !isDone(exit) {
+		t.Error("exit not done after stdin EOF")
+	}
+	if !isDone(drain) {
+		t.Error("drain not done after stdin EOF")
+	}
+}
+
+func TestWatchShutdownStop(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	drain, exit, stop := watchShutdown(parent, make(chan os.Signal), nil)
+	defer stop()
+
+	cancel()
+	if !isDone(drain) || !isDone(exit) {
+		t.Error("contexts not done after parent was cancelled")
+	}
+
+	drain, exit, stop = watchShutdown(context.Background(), make(chan os.Signal), nil)
+	stop()
+	if !isDone(drain) || !isDone(exit) {
+		t.Error("contexts not done after stop")
+	}
+}
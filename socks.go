@@ -2,25 +2,26 @@ package pt
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	socksVersion = 0x05
 
-	socksAuthNoneRequired        = 0x00
-	socksAuthUsernamePassword    = 0x02
+	// "NO AUTHENTICATION REQUIRED"; see SocksListenerConfig.AuthMethods.
+	SocksAuthNoneRequired = 0x00
+	// "USERNAME/PASSWORD"
+	SocksAuthUsernamePassword    = 0x02
 	socksAuthNoAcceptableMethods = 0xff
 
-	socksCmdConnect = 0x01
-	socksRsv        = 0x00
-
-	socksAtypeV4         = 0x01
-	socksAtypeDomainName = 0x03
-	socksAtypeV6         = 0x04
+	socksRsv = 0x00
 
 	socksAuthRFC1929Ver     = 0x01
 	socksAuthRFC1929Success = 0x00
@@ -45,14 +46,61 @@ const (
 	SocksRepAddressNotSupported = 0x08
 )
 
-// Put a sanity timeout on how long we wait for a SOCKS request.
+// SOCKS5 address types, as found in SocksRequest.AddrType.
+const (
+	SocksAddrIPv4       = 0x01
+	SocksAddrDomainName = 0x03
+	SocksAddrIPv6       = 0x04
+)
+
+// SOCKS5 commands, as found in SocksRequest.Command.
+const (
+	SocksCmdConnect      = 0x01
+	SocksCmdBind         = 0x02
+	SocksCmdUDPAssociate = 0x03
+	// Tor extensions (socks-extensions.txt section 2): resolve the host
+	// name in SocksRequest.Target to an address, or an address to a host
+	// name.
+	SocksCmdResolve    = 0xf0
+	SocksCmdResolvePTR = 0xf1
+)
+
+// Put a sanity timeout on how long we wait for a SOCKS request, unless
+// SocksListenerConfig.HandshakeTimeout says otherwise.
 const socksRequestTimeout = 5 * time.Second
 
+// How many SOCKS handshakes may be in progress at once, unless
+// SocksListenerConfig.MaxConcurrentHandshakes says otherwise.
+const socksMaxConcurrentHandshakes = 64
+
 // SocksRequest describes a SOCKS request.
 type SocksRequest struct {
-	// The endpoint requested by the client as a "host:port" string.
+	// The SOCKS version spoken by the client: 5, or 4 for SOCKS4 and
+	// SOCKS4a clients, which are accepted only if
+	// SocksListenerConfig.AllowSocks4 is set. It is 0 in the request of an
+	// HttpConnectConn.
+	Version byte
+	// The command requested by the client: SocksCmdConnect, unless other
+	// commands are enabled in the listener's SocksListenerConfig.
+	Command byte
+	// The endpoint requested by the client as a "host:port" string. For
+	// SocksCmdUDPAssociate, this is the address from which the client
+	// expects to send datagrams, and may be all zeroes if the client does
+	// not know it. For SocksCmdResolve and SocksCmdResolvePTR, the port is
+	// not meaningful.
 	Target string
-	// The userid string sent by the client.
+	// The type of address in the request: SocksAddrIPv4, SocksAddrIPv6, or
+	// SocksAddrDomainName.
+	AddrType byte
+	// The host part of Target: the domain name exactly as the client sent
+	// it, or the IP address in string form, without brackets.
+	Host string
+	// The requested IP address, or nil if AddrType is SocksAddrDomainName.
+	IP net.IP
+	// The requested port.
+	Port int
+	// The userid string sent by the client. For SOCKS4, this is the USERID
+	// field.
 	Username string
 	// The password string sent by the client.
 	Password string
@@ -64,13 +112,126 @@ type SocksRequest struct {
 type SocksConn struct {
 	net.Conn
 	Req SocksRequest
+
+	mu sync.Mutex
+	// Which replies have been sent.
+	state socksReplyState
+}
+
+// The progress of a SocksConn through its replies.
+type socksReplyState int
+
+const (
+	// No reply has been sent yet.
+	socksNoReply socksReplyState = iota
+	// The first of the two replies to a BIND request has been sent.
+	socksBindListening
+	// The request was granted; data may be relayed.
+	socksGranted
+	// The request was rejected.
+	socksRejected
+)
+
+// Errors returned when the methods of a SocksConn are called out of order.
+var (
+	errSocksReplied    = errors.New("SOCKS reply already sent")
+	errSocksNotGranted = errors.New("SOCKS request has not been granted")
+)
+
+// Send a reply with the given code and encoded BND.ADDR/BND.PORT (nil for
+// "0.0.0.0:0"), moving to state next. Returns an error without sending
+// anything if a final reply has already been sent, or if from is not the
+// current state.
+func (conn *SocksConn) reply(from, next socksReplyState, code byte, bnd []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.state != from {
+		switch conn.state {
+		case socksGranted, socksRejected:
+			return errSocksReplied
+		}
+		return fmt.Errorf("SOCKS reply out of order")
+	}
+	// Even if sending fails, do not try again.
+	conn.state = next
+	return conn.send(code, bnd)
+}
+
+// Send a reply in the client's version of SOCKS, without checking the state.
+func (conn *SocksConn) send(code byte, bnd []byte) error {
+	if conn.Req.Version == socks4Version {
+		return sendSocks4Response(conn.Conn, code, bnd)
+	}
+	return sendSocks5Response(conn.Conn, code, bnd)
+}
+
+// Report whether the request has been granted.
+func (conn *SocksConn) granted() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.state == socksGranted
+}
+
+// Read data relayed from the client. Returns an error if the request has not
+// been granted.
+func (conn *SocksConn) Read(b []byte) (int, error) {
+	if !conn.granted() {
+		return 0, errSocksNotGranted
+	}
+	return conn.Conn.Read(b)
+}
+
+// Write data to be relayed to the client. Returns an error if the request has
+// not been granted.
+func (conn *SocksConn) Write(b []byte) (int, error) {
+	if !conn.granted() {
+		return 0, errSocksNotGranted
+	}
+	return conn.Conn.Write(b)
+}
+
+// Close the connection. If no reply has been sent, a "General Failure" reply
+// is sent first, so the client is not left waiting for one.
+func (conn *SocksConn) Close() error {
+	conn.mu.Lock()
+	switch conn.state {
+	case socksNoReply, socksBindListening:
+		// Swallow the error; the connection is being closed anyway.
+		conn.send(SocksRepGeneralFailure, nil)
+		conn.state = socksRejected
+	}
+	conn.mu.Unlock()
+	return conn.Conn.Close()
 }
 
 // Send a message to the proxy client that access to the given address is
-// granted. Addr is ignored, and "0.0.0.0:0" is always sent back for
-// BND.ADDR/BND.PORT in the SOCKS response.
+// granted. addr is sent back in BND.ADDR/BND.PORT of the SOCKS response; it
+// should be the local address of the outgoing connection. If addr is nil,
+// "0.0.0.0:0" is sent instead, which is all that tor needs. Returns an error if
+// a reply has already been sent.
 func (conn *SocksConn) Grant(addr *net.TCPAddr) error {
-	return sendSocks5ResponseGranted(conn)
+	if addr == nil {
+		return conn.GrantAddr(nil)
+	}
+	return conn.GrantAddr(addr)
+}
+
+// Like Grant, but takes any net.Addr. The address is encoded as an IPv4
+// address, an IPv6 address, or a domain name, according to its String form,
+// so it may be an address that does not refer to an IP address, as long as its
+// String method returns a "host:port" string. If addr is nil, "0.0.0.0:0" is
+// sent.
+// 	err = conn.GrantAddr(remote.LocalAddr())
+func (conn *SocksConn) GrantAddr(addr net.Addr) error {
+	var bnd []byte
+	if addr != nil {
+		var err error
+		bnd, err = socksEncodeNetAddr(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.reply(socksNoReply, socksGranted, socksRepSucceeded, bnd)
 }
 
 // Send a message to the proxy client that access was rejected or failed.  This
@@ -81,9 +242,273 @@ func (conn *SocksConn) Reject() error {
 }
 
 // Send a message to the proxy client that access was rejected, with the
-// specific error code indicating the reason behind the rejection.
+// specific error code indicating the reason behind the rejection. Returns an
+// error if a reply has already been sent, except that the second reply to a
+// BIND request may be a rejection.
 func (conn *SocksConn) RejectReason(reason byte) error {
-	return sendSocks5ResponseRejected(conn, reason)
+	conn.mu.Lock()
+	from := conn.state
+	conn.mu.Unlock()
+	if from != socksBindListening {
+		from = socksNoReply
+	}
+	return conn.reply(from, socksRejected, reason, nil)
+}
+
+// Send a message to the proxy client that access failed, with an error code
+// chosen according to err, which is typically the error from dialing
+// conn.Req.Target: "Connection refused" for a refused connection, "Host
+// unreachable" for an unreachable host or a failed DNS lookup, "Network
+// unreachable" for an unreachable network, and "TTL expired" for a timeout.
+// Any other error gets "General Failure", as with Reject.
+// 	remote, err := net.Dial("tcp", conn.Req.Target)
+// 	if err != nil {
+// 		conn.RejectError(err)
+// 		return err
+// 	}
+func (conn *SocksConn) RejectError(err error) error {
+	return conn.RejectReason(socksRepForError(err))
+}
+
+// Return the SOCKS5 reply code that best describes err.
+func socksRepForError(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return SocksRepConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return SocksRepHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return SocksRepNetworkUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT):
+		return SocksRepTTLExpired
+	case errors.As(err, &dnsErr):
+		// A timeout during resolution is still a timeout.
+		if dnsErr.Timeout() {
+			return SocksRepTTLExpired
+		}
+		return SocksRepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return SocksRepTTLExpired
+	}
+	return SocksRepGeneralFailure
+}
+
+// Send the first of the two replies to a BIND request, telling the client the
+// address addr on which the proxy is listening for the incoming connection.
+// After the incoming connection arrives, call BindAccepted; or call
+// RejectReason if it never does.
+//
+// 	ln, err := net.Listen("tcp", ":0")
+// 	if err != nil {
+// 		conn.Reject()
+// 		return err
+// 	}
+// 	defer ln.Close()
+// 	err = conn.BindListening(ln.Addr())
+// 	if err != nil {
+// 		return err
+// 	}
+// 	remote, err := ln.Accept()
+// 	if err != nil {
+// 		conn.Reject()
+// 		return err
+// 	}
+// 	defer remote.Close()
+// 	err = conn.BindAccepted(remote.RemoteAddr())
+// 	if err != nil {
+// 		return err
+// 	}
+// 	// do something with conn and remote
+func (conn *SocksConn) BindListening(addr net.Addr) error {
+	if conn.Req.Command != SocksCmdBind {
+		return fmt.Errorf("BindListening called for SOCKS command 0x%02x", conn.Req.Command)
+	}
+	bnd, err := socksEncodeNetAddr(addr)
+	if err != nil {
+		return err
+	}
+	return conn.reply(socksNoReply, socksBindListening, socksRepSucceeded, bnd)
+}
+
+// Send the second of the two replies to a BIND request, telling the client the
+// address peer of the host that connected. Data may be relayed after this.
+func (conn *SocksConn) BindAccepted(peer net.Addr) error {
+	if conn.Req.Command != SocksCmdBind {
+		return fmt.Errorf("BindAccepted called for SOCKS command 0x%02x", conn.Req.Command)
+	}
+	bnd, err := socksEncodeNetAddr(peer)
+	if err != nil {
+		return err
+	}
+	return conn.reply(socksBindListening, socksGranted, socksRepSucceeded, bnd)
+}
+
+// Reply to a RESOLVE request with the address that the host name in
+// conn.Req.Target resolved to. If resolution failed, call RejectReason instead,
+// for example with SocksRepHostUnreachable.
+func (conn *SocksConn) GrantResolve(ip net.IP) error {
+	if conn.Req.Command != SocksCmdResolve {
+		return fmt.Errorf("GrantResolve called for SOCKS command 0x%02x", conn.Req.Command)
+	}
+	if ip == nil {
+		return fmt.Errorf("GrantResolve called with nil IP address")
+	}
+	bnd, err := socksEncodeAddr(ip.String(), 0)
+	if err != nil {
+		return err
+	}
+	return conn.reply(socksNoReply, socksGranted, socksRepSucceeded, bnd)
+}
+
+// Reply to a RESOLVE_PTR request with the host name that the address in
+// conn.Req.Target resolved to. If resolution failed, call RejectReason instead,
+// for example with SocksRepHostUnreachable.
+func (conn *SocksConn) GrantResolvePTR(hostname string) error {
+	if conn.Req.Command != SocksCmdResolvePTR {
+		return fmt.Errorf("GrantResolvePTR called for SOCKS command 0x%02x", conn.Req.Command)
+	}
+	if net.ParseIP(hostname) != nil {
+		return fmt.Errorf("GrantResolvePTR called with IP address %q", hostname)
+	}
+	bnd, err := socksEncodeAddr(hostname, 0)
+	if err != nil {
+		return err
+	}
+	return conn.reply(socksNoReply, socksGranted, socksRepSucceeded, bnd)
+}
+
+// SocksHandshakeErrorKind classifies the ways a SOCKS handshake can fail.
+type SocksHandshakeErrorKind int
+
+const (
+	// Any failure not covered by another kind, such as the client
+	// disconnecting in the middle of the handshake.
+	SocksErrOther SocksHandshakeErrorKind = iota
+	// The client sent the wrong SOCKS or RFC 1929 version number.
+	SocksErrBadVersion
+	// The client sent a message that is badly formatted in some other way.
+	SocksErrMalformed
+	// The username and password did not parse as pluggable transport
+	// arguments.
+	SocksErrBadArgs
+	// The client offered no acceptable authentication method, or its
+	// credentials were refused by SocksListenerConfig.ValidateCredentials.
+	SocksErrAuthFailed
+	// The client requested a command that is not enabled.
+	SocksErrUnsupportedCommand
+	// The client sent an address type other than IPv4, IPv6, or domain name.
+	SocksErrUnsupportedAddrType
+	// The client did not finish the handshake within the handshake timeout.
+	SocksErrTimeout
+	// SocksListenerConfig.AcceptHook or SocksListenerConfig.RequestHook
+	// refused the connection.
+	SocksErrRejected
+
+	socksNumErrorKinds
+)
+
+func (kind SocksHandshakeErrorKind) String() string {
+	switch kind {
+	case SocksErrOther:
+		return "other"
+	case SocksErrBadVersion:
+		return "bad version"
+	case SocksErrMalformed:
+		return "malformed message"
+	case SocksErrBadArgs:
+		return "bad args"
+	case SocksErrAuthFailed:
+		return "authentication failed"
+	case SocksErrUnsupportedCommand:
+		return "unsupported command"
+	case SocksErrUnsupportedAddrType:
+		return "unsupported address type"
+	case SocksErrTimeout:
+		return "timeout"
+	case SocksErrRejected:
+		return "rejected"
+	}
+	return fmt.Sprintf("SocksHandshakeErrorKind(%d)", int(kind))
+}
+
+// SocksHandshakeError describes a connection that was closed by AcceptSocks
+// because its SOCKS handshake failed. It is passed to
+// SocksListenerConfig.HandshakeErrorHook.
+// 	ln := pt.NewSocksListenerConfig(tcpLn, pt.SocksListenerConfig{
+// 		HandshakeErrorHook: func(err *pt.SocksHandshakeError) {
+// 			pt.Log(pt.LogSeverityWarning, err.Error())
+// 		},
+// 	})
+type SocksHandshakeError struct {
+	// The address of the client.
+	RemoteAddr net.Addr
+	// What kind of failure it was.
+	Kind SocksHandshakeErrorKind
+	// The underlying error.
+	Err error
+}
+
+func (err *SocksHandshakeError) Error() string {
+	if err.RemoteAddr != nil {
+		return fmt.Sprintf("SOCKS handshake with %s failed (%s): %s", err.RemoteAddr, err.Kind, err.Err)
+	}
+	return fmt.Sprintf("SOCKS handshake failed (%s): %s", err.Kind, err.Err)
+}
+
+func (err *SocksHandshakeError) Unwrap() error {
+	return err.Err
+}
+
+// Return a *SocksHandshakeError of the given kind with a formatted message.
+func socksKindError(kind SocksHandshakeErrorKind, format string, a ...interface{}) error {
+	return &SocksHandshakeError{Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// Return a *SocksHandshakeError for a handshake with remote that failed with
+// err. If err is already a *SocksHandshakeError, its kind is kept; otherwise
+// the kind is SocksErrTimeout for timeouts and SocksErrOther for anything else.
+func newSocksHandshakeError(remote net.Addr, err error) *SocksHandshakeError {
+	herr := &SocksHandshakeError{RemoteAddr: remote, Kind: SocksErrOther, Err: err}
+	var kindErr *SocksHandshakeError
+	var netErr net.Error
+	if errors.As(err, &kindErr) {
+		herr.Kind = kindErr.Kind
+		herr.Err = kindErr.Err
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		herr.Kind = SocksErrTimeout
+	}
+	return herr
+}
+
+// Counts of failed handshakes by kind, for HandshakeErrorCount.
+type handshakeErrorCounts struct {
+	mu     sync.Mutex
+	counts [socksNumErrorKinds]uint64
+}
+
+// Classify err, the error from a failed handshake with remote, count it, and
+// pass it to hook if hook is not nil. Returns the classified error.
+func (e *handshakeErrorCounts) add(remote net.Addr, err error, hook func(*SocksHandshakeError)) *SocksHandshakeError {
+	herr := newSocksHandshakeError(remote, err)
+	e.mu.Lock()
+	e.counts[herr.Kind]++
+	e.mu.Unlock()
+	if hook != nil {
+		hook(herr)
+	}
+	return herr
+}
+
+// Return the count of failures of the given kind.
+func (e *handshakeErrorCounts) get(kind SocksHandshakeErrorKind) uint64 {
+	if kind < 0 || kind >= socksNumErrorKinds {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.counts[kind]
 }
 
 // SocksListener wraps a net.Listener in order to read a SOCKS request on Accept.
@@ -92,11 +517,11 @@ func (conn *SocksConn) RejectReason(reason byte) error {
 // 		defer conn.Close()
 // 		remote, err := net.Dial("tcp", conn.Req.Target)
 // 		if err != nil {
-// 			conn.Reject()
+// 			conn.RejectError(err)
 // 			return err
 // 		}
 // 		defer remote.Close()
-// 		err = conn.Grant(remote.RemoteAddr().(*net.TCPAddr))
+// 		err = conn.GrantAddr(remote.LocalAddr())
 // 		if err != nil {
 // 			return err
 // 		}
@@ -121,6 +546,120 @@ func (conn *SocksConn) RejectReason(reason byte) error {
 // 	}
 type SocksListener struct {
 	net.Listener
+	config SocksListenerConfig
+
+	loop handshakeLoop
+	errs handshakeErrorCounts
+}
+
+// SocksListenerConfig holds options for a SocksListener created with
+// NewSocksListenerConfig. The zero value gives the same behavior as
+// NewSocksListener.
+type SocksListenerConfig struct {
+	// How long a client has to complete the SOCKS handshake, up to the end
+	// of its request. If 0, the default of 5 seconds is used.
+	HandshakeTimeout time.Duration
+
+	// The authentication methods that the listener accepts, from among
+	// SocksAuthNoneRequired and SocksAuthUsernamePassword. If the client
+	// offers none of them, it gets a "NO ACCEPTABLE METHODS" reply. If
+	// empty, both are accepted, with SocksAuthUsernamePassword preferred.
+	AuthMethods []byte
+
+	// The SOCKS commands that the listener accepts; for any other command,
+	// the client gets a "Command not supported" reply. If empty, only
+	// SocksCmdConnect is accepted. Check SocksRequest.Command to see which
+	// command was requested.
+	Commands []byte
+
+	// If true, the listener also accepts SOCKS4 and SOCKS4a clients,
+	// telling them apart from SOCKS5 clients by the first byte they send.
+	// SOCKS4 has only the SocksCmdConnect and SocksCmdBind commands, and
+	// no authentication: the USERID field is parsed as Args, the way the
+	// SOCKS5 username and password are, and passed to ValidateCredentials
+	// with an empty password. If AuthMethods does not include
+	// SocksAuthNoneRequired, a SOCKS4 request with an empty USERID is
+	// rejected, as a SOCKS5 client that offers no credentials would be.
+	// Replies are sent in the client's version of SOCKS; check
+	// SocksRequest.Version to see which one it used. The listener's
+	// Version method returns "socks4".
+	AllowSocks4 bool
+
+	// The maximum number of SOCKS handshakes that may be in progress at
+	// once. Handshakes happen concurrently, so that a slow client does not
+	// hold up others. If 0, the default of 64 is used.
+	MaxConcurrentHandshakes int
+
+	// If not nil, ValidateCredentials is called with the username and
+	// password of each client that uses SocksAuthUsernamePassword, exactly
+	// as the client sent them, and with the Args parsed from them. If it
+	// returns an error, the client gets an RFC 1929 failure reply and the
+	// connection is closed. Clients that use SocksAuthNoneRequired are not
+	// validated; to require every client to authenticate, also set
+	// AuthMethods to []byte{SocksAuthUsernamePassword}.
+	ValidateCredentials func(username, password string, args Args) error
+
+	// If not nil, HandshakeErrorHook is called with the error for each
+	// connection that AcceptSocks closes because its handshake failed. It
+	// may be called from several goroutines at once.
+	HandshakeErrorHook func(err *SocksHandshakeError)
+
+	// If not nil, AcceptHook is called with each newly accepted connection
+	// before the SOCKS handshake begins. If it returns an error, the
+	// connection is closed without a reply. Use it, for example, to refuse
+	// connections from unexpected addresses.
+	AcceptHook func(c net.Conn) error
+
+	// If not nil, RequestHook is called with each request once the
+	// handshake is complete, before AcceptSocks returns it. It returns 0 to
+	// let the request through, or a reply code such as
+	// SocksRepConnectionNotAllowed to reject it.
+	RequestHook func(req *SocksRequest) byte
+}
+
+// Return config.MaxConcurrentHandshakes, or the default if it is not set.
+func (config *SocksListenerConfig) maxConcurrentHandshakes() int {
+	if config == nil || config.MaxConcurrentHandshakes <= 0 {
+		return socksMaxConcurrentHandshakes
+	}
+	return config.MaxConcurrentHandshakes
+}
+
+// Return config.HandshakeTimeout, or the default if it is not set.
+func (config *SocksListenerConfig) handshakeTimeout() time.Duration {
+	if config == nil || config.HandshakeTimeout == 0 {
+		return socksRequestTimeout
+	}
+	return config.HandshakeTimeout
+}
+
+// Report whether method is one of the authentication methods enabled by
+// config. A nil config enables SocksAuthNoneRequired and
+// SocksAuthUsernamePassword.
+func (config *SocksListenerConfig) authMethodEnabled(method byte) bool {
+	if config == nil || len(config.AuthMethods) == 0 {
+		return method == SocksAuthNoneRequired || method == SocksAuthUsernamePassword
+	}
+	for _, m := range config.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether cmd is one of the commands enabled by config. A nil config
+// enables only SocksCmdConnect.
+func (config *SocksListenerConfig) commandEnabled(cmd byte) bool {
+	if config == nil || len(config.Commands) == 0 {
+		return cmd == SocksCmdConnect
+	}
+	for _, c := range config.Commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
 }
 
 // Open a net.Listener according to network and laddr, and return it as a
@@ -135,7 +674,16 @@ func ListenSocks(network, laddr string) (*SocksListener, error) {
 
 // Create a new SocksListener wrapping the given net.Listener.
 func NewSocksListener(ln net.Listener) *SocksListener {
-	return &SocksListener{ln}
+	return &SocksListener{Listener: ln}
+}
+
+// Create a new SocksListener wrapping the given net.Listener, with the options
+// in config.
+// 	ln := pt.NewSocksListenerConfig(tcpLn, pt.SocksListenerConfig{
+// 		Commands: []byte{pt.SocksCmdConnect, pt.SocksCmdUDPAssociate},
+// 	})
+func NewSocksListenerConfig(ln net.Listener, config SocksListenerConfig) *SocksListener {
+	return &SocksListener{Listener: ln, config: config}
 }
 
 // Accept is the same as AcceptSocks, except that it returns a generic net.Conn.
@@ -146,7 +694,16 @@ func (ln *SocksListener) Accept() (net.Conn, error) {
 
 // Call Accept on the wrapped net.Listener, do SOCKS negotiation, and return a
 // SocksConn. After accepting, you must call either conn.Grant or conn.Reject
-// (presumably after trying to connect to conn.Req.Target).
+// (presumably after trying to connect to conn.Req.Target). If you close conn
+// without doing either, it is rejected with a "General Failure" reply. Data
+// cannot be read from or written to conn until it has been granted.
+//
+// Connections are accepted and negotiated in the background, each in its own
+// goroutine, up to SocksListenerConfig.MaxConcurrentHandshakes at a time.
+// AcceptSocks returns connections in the order their negotiation finishes, not
+// the order they were accepted, so a client that is slow to send its request
+// does not delay the others. Connections whose negotiation fails are closed
+// and not returned.
 //
 // Errors returned by AcceptSocks may be temporary (for example, EOF while
 // reading the request, or a badly formatted userid string), or permanent (e.g.,
@@ -167,63 +724,158 @@ func (ln *SocksListener) Accept() (net.Conn, error) {
 // 		go handleConn(conn)
 // 	}
 func (ln *SocksListener) AcceptSocks() (*SocksConn, error) {
-retry:
-	c, err := ln.Listener.Accept()
+	ln.init()
+	c, err := ln.loop.accept()
 	if err != nil {
 		return nil, err
 	}
+	return c.(*SocksConn), nil
+}
+
+// Close the wrapped net.Listener. Connections whose handshakes are in progress
+// are closed as they finish, instead of being returned by AcceptSocks.
+func (ln *SocksListener) Close() error {
+	ln.init()
+	ln.loop.close()
+	return ln.Listener.Close()
+}
+
+// Start the accept loop, the first time this is called.
+func (ln *SocksListener) init() {
+	ln.loop.init(ln.Listener, ln.config.maxConcurrentHandshakes(), func(c net.Conn) (net.Conn, error) {
+		conn, err := ln.handshake(c)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// Do the SOCKS handshake on c and return a SocksConn. On error, c is closed,
+// and the error is counted and passed to config.HandshakeErrorHook.
+func (ln *SocksListener) handshake(c net.Conn) (*SocksConn, error) {
+	conn, err := ln.handshakeConn(c)
+	if err != nil {
+		return nil, ln.errs.add(c.RemoteAddr(), err, ln.config.HandshakeErrorHook)
+	}
+	return conn, nil
+}
+
+// The body of handshake, without the error accounting.
+func (ln *SocksListener) handshakeConn(c net.Conn) (*SocksConn, error) {
 	conn := new(SocksConn)
 	conn.Conn = c
-	err = conn.SetDeadline(time.Now().Add(socksRequestTimeout))
+	var err error
+	// Until the handshake is done, close c rather than conn, because the
+	// handshake functions send their own error replies.
+	if ln.config.AcceptHook != nil {
+		err = ln.config.AcceptHook(c)
+		if err != nil {
+			c.Close()
+			return nil, &SocksHandshakeError{Kind: SocksErrRejected, Err: err}
+		}
+	}
+	err = conn.SetDeadline(time.Now().Add(ln.config.handshakeTimeout()))
 	if err != nil {
-		conn.Close()
-		goto retry
+		c.Close()
+		return nil, err
 	}
-	conn.Req, err = socks5Handshake(conn)
+	conn.Req, err = socksHandshake(c, &ln.config)
 	if err != nil {
-		conn.Close()
-		goto retry
+		c.Close()
+		return nil, err
+	}
+	if ln.config.RequestHook != nil {
+		code := ln.config.RequestHook(&conn.Req)
+		if code != socksRepSucceeded {
+			conn.RejectReason(code)
+			conn.Close()
+			return nil, socksKindError(SocksErrRejected, "SOCKS request rejected with code 0x%02x", code)
+		}
 	}
 	err = conn.SetDeadline(time.Time{})
 	if err != nil {
-		conn.Close()
-		goto retry
+		c.Close()
+		return nil, err
 	}
 	return conn, nil
 }
 
-// Returns "socks5", suitable to be included in a call to Cmethod.
+// Return the number of connections that have failed the SOCKS handshake with
+// an error of the given kind.
+func (ln *SocksListener) HandshakeErrorCount(kind SocksHandshakeErrorKind) uint64 {
+	return ln.errs.get(kind)
+}
+
+// Returns "socks5", or "socks4" if SocksListenerConfig.AllowSocks4 is set,
+// suitable to be included in a call to Cmethod. Tor then speaks that version of
+// SOCKS to the listener. A listener with AllowSocks4 still accepts SOCKS5; to
+// have tor keep using SOCKS5, which can reach IPv6 addresses and carry longer
+// arguments, pass "socks5" to Cmethod instead of Version().
 func (ln *SocksListener) Version() string {
+	if ln.config.AllowSocks4 {
+		return "socks4"
+	}
 	return "socks5"
 }
 
+// socksHandshake conducts the SOCKS handshake with socks5Handshake or, if
+// config allows SOCKS4 and the first byte from the client says it is SOCKS4,
+// with socks4Handshake.
+func socksHandshake(s io.ReadWriter, config *SocksListenerConfig) (req SocksRequest, err error) {
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+
+	if config != nil && config.AllowSocks4 {
+		var b []byte
+		if b, err = rw.Reader.Peek(1); err != nil {
+			return
+		}
+		if b[0] == socks4Version {
+			err = socks4Handshake(rw, &req, config)
+			return
+		}
+	}
+	return socks5Handshake(rw, config)
+}
+
 // socks5handshake conducts the SOCKS5 handshake up to the point where the
 // client command is read and the proxy must open the outgoing connection.
-// Returns a SocksRequest.
-func socks5Handshake(s io.ReadWriter) (req SocksRequest, err error) {
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+// Returns a SocksRequest. config may be nil to use the defaults.
+func socks5Handshake(rw *bufio.ReadWriter, config *SocksListenerConfig) (req SocksRequest, err error) {
+	req.Version = socksVersion
 
 	// Negotiate the authentication method.
 	var method byte
-	if method, err = socksNegotiateAuth(rw); err != nil {
+	if method, err = socksNegotiateAuth(rw, config); err != nil {
 		return
 	}
 
 	// Authenticate the client.
-	if err = socksAuthenticate(rw, method, &req); err != nil {
+	if err = socksAuthenticate(rw, method, &req, config); err != nil {
 		return
 	}
 
 	// Read the command.
-	err = socksReadCommand(rw, &req)
+	err = socksReadCommand(rw, &req, config)
 	return
 }
 
 // socksNegotiateAuth negotiates the authentication method and returns the
-// selected method as a byte.  On negotiation failures an error is returned.
-func socksNegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
+// selected method as a byte.  On negotiation failures an error is returned,
+// and the client is told that no method is acceptable.  Only the methods
+// enabled by config are selected; config may be nil.
+func socksNegotiateAuth(rw *bufio.ReadWriter, config *SocksListenerConfig) (method byte, err error) {
+	defer func() {
+		if err != nil {
+			// Swallow errors that occur when writing/flushing the
+			// response, connection will be closed anyway.
+			rw.Write([]byte{socksVersion, socksAuthNoAcceptableMethods})
+			rw.Flush()
+		}
+	}()
+
 	// Validate the version.
-	if err = socksReadByteVerify(rw, "version", socksVersion); err != nil {
+	if err = socksReadByteVerify(rw, "version", socksVersion, SocksErrBadVersion); err != nil {
 		return
 	}
 
@@ -242,19 +894,27 @@ func socksNegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 	// Pick the most "suitable" method.
 	method = socksAuthNoAcceptableMethods
 	for _, m := range methods {
+		if !config.authMethodEnabled(m) {
+			continue
+		}
 		switch m {
-		case socksAuthNoneRequired:
+		case SocksAuthNoneRequired:
 			// Pick Username/Password over None if the client happens to
 			// send both.
 			if method == socksAuthNoAcceptableMethods {
 				method = m
 			}
 
-		case socksAuthUsernamePassword:
+		case SocksAuthUsernamePassword:
 			method = m
 		}
 	}
 
+	// The client must wait for our reply before sending more.
+	if err = socksCheckNoExtra(rw); err != nil {
+		return
+	}
+
 	// Send the negotiated method.
 	var msg [2]byte
 	msg[0] = socksVersion
@@ -270,19 +930,19 @@ func socksNegotiateAuth(rw *bufio.ReadWriter) (method byte, err error) {
 }
 
 // socksAuthenticate authenticates the client via the chosen authentication
-// mechanism.
-func socksAuthenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (err error) {
+// mechanism.  config may be nil.
+func socksAuthenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest, config *SocksListenerConfig) (err error) {
 	switch method {
-	case socksAuthNoneRequired:
+	case SocksAuthNoneRequired:
 		// Straight into reading the connect.
 
-	case socksAuthUsernamePassword:
-		if err = socksAuthRFC1929(rw, req); err != nil {
+	case SocksAuthUsernamePassword:
+		if err = socksAuthRFC1929(rw, req, config); err != nil {
 			return
 		}
 
 	case socksAuthNoAcceptableMethods:
-		err = fmt.Errorf("SOCKS method select had no compatible methods")
+		err = socksKindError(SocksErrAuthFailed, "SOCKS method select had no compatible methods")
 		return
 
 	default:
@@ -299,19 +959,22 @@ func socksAuthenticate(rw *bufio.ReadWriter, method byte, req *SocksRequest) (er
 // socksAuthRFC1929 authenticates the client via RFC 1929 username/password
 // auth.  As a design decision any valid username/password is accepted as this
 // field is primarily used as an out-of-band argument passing mechanism for
-// pluggable transports.
-func socksAuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
-	sendErrResp := func() {
-		// Swallow the write/flush error here, we are going to close the
-		// connection and the original failure is more useful.
-		resp := []byte{socksAuthRFC1929Ver, socksAuthRFC1929Fail}
-		rw.Write(resp[:])
-		socksFlushBuffers(rw)
-	}
+// pluggable transports, unless config has a ValidateCredentials function that
+// says otherwise.
+func socksAuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest, config *SocksListenerConfig) (err error) {
+	defer func() {
+		if err != nil {
+			// Swallow the write/flush error here, we are going to
+			// close the connection and the original failure is more
+			// useful.
+			resp := []byte{socksAuthRFC1929Ver, socksAuthRFC1929Fail}
+			rw.Write(resp[:])
+			rw.Flush()
+		}
+	}()
 
 	// Validate the fixed parts of the command message.
-	if err = socksReadByteVerify(rw, "auth version", socksAuthRFC1929Ver); err != nil {
-		sendErrResp()
+	if err = socksReadByteVerify(rw, "auth version", socksAuthRFC1929Ver, SocksErrBadVersion); err != nil {
 		return
 	}
 
@@ -321,8 +984,7 @@ func socksAuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		return
 	}
 	if ulen < 1 {
-		sendErrResp()
-		err = fmt.Errorf("RFC1929 username with 0 length")
+		err = socksKindError(SocksErrMalformed, "RFC1929 username with 0 length")
 		return
 	}
 	var uname []byte
@@ -337,8 +999,7 @@ func socksAuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		return
 	}
 	if plen < 1 {
-		sendErrResp()
-		err = fmt.Errorf("RFC1929 password with 0 length")
+		err = socksKindError(SocksErrMalformed, "RFC1929 password with 0 length")
 		return
 	}
 	var passwd []byte
@@ -353,61 +1014,78 @@ func socksAuthRFC1929(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 	// Mash the username/password together and parse it as a pluggable
 	// transport argument string.
 	if req.Args, err = parseClientParameters(req.Username + req.Password); err != nil {
-		sendErrResp()
-	} else {
-		resp := []byte{socksAuthRFC1929Ver, socksAuthRFC1929Success}
-		_, err = rw.Write(resp[:])
+		err = &SocksHandshakeError{Kind: SocksErrBadArgs, Err: err}
+		return
+	}
+	if config != nil && config.ValidateCredentials != nil {
+		if err = config.ValidateCredentials(string(uname), string(passwd), req.Args); err != nil {
+			err = &SocksHandshakeError{Kind: SocksErrAuthFailed, Err: fmt.Errorf("RFC1929 credentials rejected: %w", err)}
+			return
+		}
+	}
+	// The client must wait for our reply before sending more.
+	if err = socksCheckNoExtra(rw); err != nil {
+		return
 	}
+	resp := []byte{socksAuthRFC1929Ver, socksAuthRFC1929Success}
+	_, err = rw.Write(resp[:])
 	return
 }
 
 // socksReadCommand reads a SOCKS5 client command and parses out the relevant
-// fields into a SocksRequest.  Only CMD_CONNECT is supported.
-func socksReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
-	sendErrResp := func(reason byte) {
-		// Swallow errors that occur when writing/flushing the response,
-		// connection will be closed anyway.
-		sendSocks5ResponseRejected(rw, reason)
-		socksFlushBuffers(rw)
-	}
+// fields into a SocksRequest.  Only the commands enabled by config are
+// supported; a nil config means only CMD_CONNECT.
+func socksReadCommand(rw *bufio.ReadWriter, req *SocksRequest, config *SocksListenerConfig) (err error) {
+	// The reply code to send if there is an error.
+	reason := byte(SocksRepGeneralFailure)
+	defer func() {
+		if err != nil {
+			// Swallow errors that occur when writing/flushing the
+			// response, connection will be closed anyway.
+			sendSocks5ResponseRejected(rw, reason)
+			rw.Flush()
+		}
+	}()
 
 	// Validate the fixed parts of the command message.
-	if err = socksReadByteVerify(rw, "version", socksVersion); err != nil {
-		sendErrResp(SocksRepGeneralFailure)
+	if err = socksReadByteVerify(rw, "version", socksVersion, SocksErrBadVersion); err != nil {
+		return
+	}
+	if req.Command, err = socksReadByte(rw); err != nil {
 		return
 	}
-	if err = socksReadByteVerify(rw, "command", socksCmdConnect); err != nil {
-		sendErrResp(SocksRepCommandNotSupported)
+	if !config.commandEnabled(req.Command) {
+		reason = SocksRepCommandNotSupported
+		err = socksKindError(SocksErrUnsupportedCommand, "SOCKS request had unsupported command 0x%02x", req.Command)
 		return
 	}
-	if err = socksReadByteVerify(rw, "reserved", socksRsv); err != nil {
-		sendErrResp(SocksRepGeneralFailure)
+	if err = socksReadByteVerify(rw, "reserved", socksRsv, SocksErrMalformed); err != nil {
 		return
 	}
 
 	// Read the destination address/port.
-	// XXX: This should probably eventually send socks 5 error messages instead
-	// of rudely closing connections on invalid addresses.
 	var atype byte
 	if atype, err = socksReadByte(rw); err != nil {
 		return
 	}
 	var host string
+	var ip net.IP
 	switch atype {
-	case socksAtypeV4:
+	case SocksAddrIPv4:
 		var addr []byte
 		if addr, err = socksReadBytes(rw, net.IPv4len); err != nil {
 			return
 		}
-		host = net.IPv4(addr[0], addr[1], addr[2], addr[3]).String()
+		ip = net.IPv4(addr[0], addr[1], addr[2], addr[3])
+		host = ip.String()
 
-	case socksAtypeDomainName:
+	case SocksAddrDomainName:
 		var alen byte
 		if alen, err = socksReadByte(rw); err != nil {
 			return
 		}
 		if alen == 0 {
-			err = fmt.Errorf("SOCKS request had domain name with 0 length")
+			err = socksKindError(SocksErrMalformed, "SOCKS request had domain name with 0 length")
 			return
 		}
 		var addr []byte
@@ -416,18 +1094,18 @@ func socksReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		}
 		host = string(addr)
 
-	case socksAtypeV6:
+	case SocksAddrIPv6:
 		var rawAddr []byte
 		if rawAddr, err = socksReadBytes(rw, net.IPv6len); err != nil {
 			return
 		}
-		addr := make(net.IP, net.IPv6len)
-		copy(addr[:], rawAddr[:])
-		host = fmt.Sprintf("[%s]", addr.String())
+		ip = make(net.IP, net.IPv6len)
+		copy(ip[:], rawAddr[:])
+		host = ip.String()
 
 	default:
-		sendErrResp(SocksRepAddressNotSupported)
-		err = fmt.Errorf("SOCKS request had unsupported address type 0x%02x", atype)
+		reason = SocksRepAddressNotSupported
+		err = socksKindError(SocksErrUnsupportedAddrType, "SOCKS request had unsupported address type 0x%02x", atype)
 		return
 	}
 	var rawPort []byte
@@ -440,22 +1118,34 @@ func socksReadCommand(rw *bufio.ReadWriter, req *SocksRequest) (err error) {
 		return
 	}
 
-	req.Target = fmt.Sprintf("%s:%d", host, port)
+	req.AddrType = atype
+	req.Host = host
+	req.IP = ip
+	req.Port = port
+	if atype == SocksAddrIPv6 {
+		req.Target = fmt.Sprintf("[%s]:%d", host, port)
+	} else {
+		req.Target = fmt.Sprintf("%s:%d", host, port)
+	}
 	return
 }
 
-// Send a SOCKS5 response with the given code. BND.ADDR/BND.PORT is always the
-// IPv4 address/port "0.0.0.0:0".
-func sendSocks5Response(w io.Writer, code byte) error {
-	resp := make([]byte, 4+4+2)
+// Send a SOCKS5 response with the given code. bnd is the encoded
+// ATYP/BND.ADDR/BND.PORT, as returned by socksEncodeAddr; if bnd is nil, the
+// IPv4 address/port "0.0.0.0:0" is sent.
+func sendSocks5Response(w io.Writer, code byte, bnd []byte) error {
+	resp := make([]byte, 3, 4+4+2)
 	resp[0] = socksVersion
 	resp[1] = code
 	resp[2] = socksRsv
-	resp[3] = socksAtypeV4
-
-	// BND.ADDR/BND.PORT should be the address and port that the outgoing
-	// connection is bound to on the proxy, but Tor does not use this
-	// information, so all zeroes are sent.
+	if bnd != nil {
+		resp = append(resp, bnd...)
+	} else {
+		// BND.ADDR/BND.PORT should be the address and port that the
+		// outgoing connection is bound to on the proxy, but Tor does not
+		// use this information, so all zeroes are sent.
+		resp = append(resp, SocksAddrIPv4, 0, 0, 0, 0, 0, 0)
+	}
 
 	_, err := w.Write(resp[:])
 	return err
@@ -463,24 +1153,130 @@ func sendSocks5Response(w io.Writer, code byte) error {
 
 // Send a SOCKS5 response code 0x00.
 func sendSocks5ResponseGranted(w io.Writer) error {
-	return sendSocks5Response(w, socksRepSucceeded)
+	return sendSocks5Response(w, socksRepSucceeded, nil)
 }
 
 // Send a SOCKS5 response with the provided failure reason.
 func sendSocks5ResponseRejected(w io.Writer, reason byte) error {
-	return sendSocks5Response(w, reason)
+	return sendSocks5Response(w, reason, nil)
 }
 
-func socksFlushBuffers(rw *bufio.ReadWriter) error {
-	if err := rw.Writer.Flush(); err != nil {
-		return err
+// Encode host and port as the ATYP, ADDR, and PORT fields of a SOCKS5 message.
+// host may be an IPv4 or IPv6 address literal or a domain name.
+func socksEncodeAddr(host string, port int) ([]byte, error) {
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, SocksAddrIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, SocksAddrIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("domain name %q has bad length %d", host, len(host))
+		}
+		b = append(b, SocksAddrDomainName, byte(len(host)))
+		b = append(b, host...)
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("port %d out of range", port)
 	}
+	b = append(b, byte(port>>8), byte(port))
+	return b, nil
+}
+
+// Like socksEncodeAddr, but takes a net.Addr such as a *net.TCPAddr or a
+// *net.UDPAddr. A nil IP is encoded as 0.0.0.0.
+func socksEncodeNetAddr(addr net.Addr) ([]byte, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return socksEncodeAddr(socksIPString(addr.IP), addr.Port)
+	case *net.UDPAddr:
+		return socksEncodeAddr(socksIPString(addr.IP), addr.Port)
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return nil, err
+	}
+	return socksEncodeAddr(host, port)
+}
+
+// Return ip as a string for socksEncodeAddr. net.IP.String returns "<nil>"
+// for an empty IP, which would be encoded as a domain name; return the
+// unspecified IPv4 address instead.
+func socksIPString(ip net.IP) string {
+	if len(ip) == 0 {
+		return net.IPv4zero.String()
+	}
+	return ip.String()
+}
+
+// Decode the ATYP, ADDR, and PORT fields of a SOCKS5 message at the beginning
+// of b. Returns the host (an IP address literal without brackets, or a domain
+// name), the port, and the number of bytes consumed.
+func socksDecodeAddr(b []byte) (host string, port int, n int, err error) {
+	if len(b) < 1 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	switch b[0] {
+	case SocksAddrIPv4:
+		n = 1 + net.IPv4len
+		if len(b) < n+2 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		host = net.IP(b[1:n]).String()
+	case SocksAddrDomainName:
+		if len(b) < 2 || b[1] == 0 {
+			err = fmt.Errorf("SOCKS address had domain name with 0 length")
+			return
+		}
+		n = 2 + int(b[1])
+		if len(b) < n+2 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		host = string(b[2:n])
+	case SocksAddrIPv6:
+		n = 1 + net.IPv6len
+		if len(b) < n+2 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		host = net.IP(b[1:n]).String()
+	default:
+		err = fmt.Errorf("SOCKS address had unsupported address type 0x%02x", b[0])
+		return
+	}
+	port = int(b[n])<<8 | int(b[n+1])
+	n += 2
+	return
+}
+
+// Return an error if the client has sent more than the message just read.
+func socksCheckNoExtra(rw *bufio.ReadWriter) error {
 	if rw.Reader.Buffered() > 0 {
-		return fmt.Errorf("%d bytes left after SOCKS message", rw.Reader.Buffered())
+		return socksKindError(SocksErrMalformed, "%d bytes left after SOCKS message", rw.Reader.Buffered())
 	}
 	return nil
 }
 
+// Flush any reply written to rw, then check, as socksCheckNoExtra does, that
+// the client has not sent more than the message just read.
+func socksFlushBuffers(rw *bufio.ReadWriter) error {
+	if err := rw.Writer.Flush(); err != nil {
+		return err
+	}
+	return socksCheckNoExtra(rw)
+}
+
 func socksReadByte(rw *bufio.ReadWriter) (byte, error) {
 	return rw.Reader.ReadByte()
 }
@@ -493,13 +1289,15 @@ func socksReadBytes(rw *bufio.ReadWriter, n int) ([]byte, error) {
 	return ret, nil
 }
 
-func socksReadByteVerify(rw *bufio.ReadWriter, descr string, expected byte) error {
+// Read a byte and check that it is expected; if not, return an error of the
+// given kind.
+func socksReadByteVerify(rw *bufio.ReadWriter, descr string, expected byte, kind SocksHandshakeErrorKind) error {
 	val, err := socksReadByte(rw)
 	if err != nil {
 		return err
 	}
 	if val != expected {
-		return fmt.Errorf("SOCKS message field %s was 0x%02x, not 0x%02x", descr, val, expected)
+		return socksKindError(kind, "SOCKS message field %s was 0x%02x, not 0x%02x", descr, val, expected)
 	}
 	return nil
 }
@@ -0,0 +1,144 @@
+package pt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The longest USERID or HOSTNAME we accept in a SOCKS4 request, not counting
+// the terminating NUL.
+const socks4MaxStringLen = 255
+
+// socks4Handshake reads a SOCKS4 or SOCKS4a request and parses out the relevant
+// fields into a SocksRequest. Only SocksCmdConnect and SocksCmdBind are
+// possible, and only if enabled by config. If config does not enable
+// SocksAuthNoneRequired, the USERID must not be empty. On failure, a "request
+// rejected" reply is sent.
+//
+// 	+----+----+----+----+----+----+----+----+----+----+....+----+
+// 	| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+// 	+----+----+----+----+----+----+----+----+----+----+....+----+
+// 	   1    1      2              4           variable       1
+//
+// In SOCKS4a, a DSTIP of 0.0.0.x, with x nonzero, means that a HOSTNAME,
+// also NUL-terminated, follows the USERID.
+func socks4Handshake(rw *bufio.ReadWriter, req *SocksRequest, config *SocksListenerConfig) (err error) {
+	defer func() {
+		if err != nil {
+			// Swallow errors that occur when writing/flushing the
+			// response, connection will be closed anyway.
+			sendSocks4Response(rw, SocksRepGeneralFailure, nil)
+			rw.Flush()
+		}
+	}()
+
+	req.Version = socks4Version
+	if err = socksReadByteVerify(rw, "version", socks4Version, SocksErrBadVersion); err != nil {
+		return
+	}
+	var cd byte
+	if cd, err = socksReadByte(rw); err != nil {
+		return
+	}
+	switch cd {
+	case socks4CmdConnect:
+		req.Command = SocksCmdConnect
+	case socks4CmdBind:
+		req.Command = SocksCmdBind
+	default:
+		err = socksKindError(SocksErrUnsupportedCommand, "SOCKS4 request had unsupported command 0x%02x", cd)
+		return
+	}
+	if !config.commandEnabled(req.Command) {
+		err = socksKindError(SocksErrUnsupportedCommand, "SOCKS4 request had unsupported command 0x%02x", cd)
+		return
+	}
+	var rawPort, rawIP []byte
+	if rawPort, err = socksReadBytes(rw, 2); err != nil {
+		return
+	}
+	if rawIP, err = socksReadBytes(rw, net.IPv4len); err != nil {
+		return
+	}
+	if req.Username, err = socks4ReadString(rw, "USERID"); err != nil {
+		return
+	}
+
+	if rawIP[0] == 0 && rawIP[1] == 0 && rawIP[2] == 0 && rawIP[3] != 0 {
+		req.AddrType = SocksAddrDomainName
+		if req.Host, err = socks4ReadString(rw, "HOSTNAME"); err != nil {
+			return
+		}
+		if len(req.Host) == 0 {
+			err = socksKindError(SocksErrMalformed, "SOCKS4a request had hostname with 0 length")
+			return
+		}
+	} else {
+		req.AddrType = SocksAddrIPv4
+		req.IP = net.IPv4(rawIP[0], rawIP[1], rawIP[2], rawIP[3])
+		req.Host = req.IP.String()
+	}
+	req.Port = int(rawPort[0])<<8 | int(rawPort[1])
+	req.Target = fmt.Sprintf("%s:%d", req.Host, req.Port)
+
+	// An empty USERID is SOCKS4's way of sending no credentials.
+	if req.Username == "" && !config.authMethodEnabled(SocksAuthNoneRequired) {
+		err = socksKindError(SocksErrAuthFailed, "SOCKS4 request had empty USERID")
+		return
+	}
+	if req.Args, err = parseClientParameters(req.Username); err != nil {
+		err = &SocksHandshakeError{Kind: SocksErrBadArgs, Err: err}
+		return
+	}
+	if config.ValidateCredentials != nil {
+		if err = config.ValidateCredentials(req.Username, "", req.Args); err != nil {
+			err = &SocksHandshakeError{Kind: SocksErrAuthFailed, Err: fmt.Errorf("SOCKS4 USERID rejected: %w", err)}
+			return
+		}
+	}
+
+	err = socksFlushBuffers(rw)
+	return
+}
+
+// Read a NUL-terminated string of at most socks4MaxStringLen bytes, not
+// including the NUL, which is consumed but not returned.
+func socks4ReadString(rw *bufio.ReadWriter, descr string) (string, error) {
+	var buf []byte
+	for {
+		b, err := socksReadByte(rw)
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxStringLen {
+			return "", socksKindError(SocksErrMalformed, "SOCKS4 %s longer than %d bytes", descr, socks4MaxStringLen)
+		}
+		buf = append(buf, b)
+	}
+}
+
+// Send a SOCKS4 reply. code is a SOCKS5 reply code: socksRepSucceeded becomes
+// "request granted", and anything else becomes "request rejected or failed",
+// because SOCKS4 has no finer distinction that applies. bnd is as for
+// sendSocks5Response; its port and address are sent in DSTPORT and DSTIP if it
+// is an IPv4 address, and zeroes otherwise.
+func sendSocks4Response(w io.Writer, code byte, bnd []byte) error {
+	resp := make([]byte, 8)
+	resp[0] = socks4ReplyVersion
+	if code == socksRepSucceeded {
+		resp[1] = socks4ReplyGranted
+	} else {
+		resp[1] = socks4ReplyRejected
+	}
+	if len(bnd) == 1+net.IPv4len+2 && bnd[0] == SocksAddrIPv4 {
+		copy(resp[2:4], bnd[5:7])
+		copy(resp[4:8], bnd[1:5])
+	}
+	_, err := w.Write(resp)
+	return err
+}
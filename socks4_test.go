@@ -0,0 +1,197 @@
+package pt
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSocks4Request tests parsing SOCKS4 and SOCKS4a requests.
+func TestSocks4Request(t *testing.T) {
+	config := &SocksListenerConfig{AllowSocks4: true}
+	c := new(testReadWriter)
+	var req SocksRequest
+
+	// VN = 04, CD = 01, DSTPORT = 9050, DSTIP = 127.0.0.1, USERID = "key=value"
+	c.writeHex("0401235a7f0000016b65793d76616c756500")
+	if err := socks4Handshake(c.toBufio(), &req, config); err != nil {
+		t.Error("socks4Handshake(IPv4) failed:", err)
+	}
+	if msg := c.readHex(); msg != "" {
+		t.Error("socks4Handshake(IPv4) unexpected response:", msg)
+	}
+	if req.Version != 4 || req.Command != SocksCmdConnect || req.Target != "127.0.0.1:9050" ||
+		req.AddrType != SocksAddrIPv4 || !req.IP.Equal(net.ParseIP("127.0.0.1")) || req.Port != 9050 {
+		t.Errorf("socks4Handshake(IPv4) unexpected request %+v", req)
+	}
+	if v, ok := req.Args.Get("key"); !ok || v != "value" {
+		t.Error("socks4Handshake(IPv4) unexpected args:", req.Args)
+	}
+	c.reset()
+
+	// VN = 04, CD = 01, DSTPORT = 443, DSTIP = 0.0.0.1, USERID = "",
+	// HOSTNAME = "example.com"
+	req = SocksRequest{}
+	c.writeHex("040101bb0000000100" + "6578616d706c652e636f6d00")
+	if err := socks4Handshake(c.toBufio(), &req, config); err != nil {
+		t.Error("socks4Handshake(Hostname) failed:", err)
+	}
+	if req.Target != "example.com:443" || req.AddrType != SocksAddrDomainName || req.Host != "example.com" || req.IP != nil {
+		t.Errorf("socks4Handshake(Hostname) unexpected request %+v", req)
+	}
+	if len(req.Args) != 0 {
+		t.Error("socks4Handshake(Hostname) unexpected args:", req.Args)
+	}
+
+	tests := [...]struct {
+		name  string
+		input string
+	}{
+		{"unsupported command", "0403235a7f00000100"},
+		{"BIND not enabled", "0402235a7f00000100"},
+		{"short DSTIP", "0401235a7f00"},
+		{"unterminated USERID", "0401235a7f0000016b6579"},
+		{"bad args", "0401235a7f0000016b657900"},
+		{"empty hostname", "0401235a000000010000"},
+		{"extra data", "0401235a7f00000100ff"},
+	}
+	for _, test := range tests {
+		c.reset()
+		req = SocksRequest{}
+		c.writeHex(test.input)
+		if err := socks4Handshake(c.toBufio(), &req, config); err == nil {
+			t.Errorf("socks4Handshake(%s) unexpectedly succeeded", test.name)
+		}
+		if msg := c.readHex(); msg != "005b000000000000" {
+			t.Errorf("socks4Handshake(%s) invalid response: %s", test.name, msg)
+		}
+	}
+}
+
+// TestSocks4Reply tests that SocksConn replies in SOCKS4 to a SOCKS4 client.
+func TestSocks4Reply(t *testing.T) {
+	rec := new(replyRecorder)
+	conn := &SocksConn{Conn: rec, Req: SocksRequest{Version: 4}}
+	if err := conn.Grant(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 80}); err != nil {
+		t.Error("Grant failed:", err)
+	}
+	if msg := rec.readHex(); msg != "005a005001020304" {
+		t.Error("Grant invalid response:", msg)
+	}
+
+	conn = &SocksConn{Conn: rec, Req: SocksRequest{Version: 4}}
+	if err := conn.RejectReason(SocksRepConnectionRefused); err != nil {
+		t.Error("RejectReason failed:", err)
+	}
+	if msg := rec.readHex(); msg != "005b000000000000" {
+		t.Error("RejectReason invalid response:", msg)
+	}
+}
+
+// TestSocks4Listener tests that a listener with AllowSocks4 accepts both SOCKS4a
+// and SOCKS5 clients, and that one without it rejects SOCKS4.
+func TestSocks4Listener(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{AllowSocks4: allow})
+		defer ln.Close()
+		expected := "socks5"
+		if allow {
+			expected = "socks4"
+		}
+		if v := ln.Version(); v != expected {
+			t.Errorf("Version() → %q (expected %q)", v, expected)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			errs <- socks4aClientHandshake(c, "example.com", 443, "key=value")
+		}()
+		if !allow {
+			go ln.AcceptSocks()
+			if err := <-errs; err == nil {
+				t.Error("SOCKS4a handshake succeeded without AllowSocks4")
+			}
+			continue
+		}
+
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Req.Version != 4 || conn.Req.Target != "example.com:443" {
+			t.Errorf("unexpected SOCKS4a request %+v", conn.Req)
+		}
+		if v, _ := conn.Req.Args.Get("key"); v != "value" {
+			t.Error("unexpected SOCKS4a args:", conn.Req.Args)
+		}
+		conn.Grant(nil)
+		if err := <-errs; err != nil {
+			t.Error("SOCKS4a handshake failed:", err)
+		}
+		conn.Close()
+
+		go func() {
+			c, err := DialSocks(ln.Addr().String(), "example.com:443", Args{"key": []string{"value"}})
+			if err == nil {
+				c.Close()
+			}
+			errs <- err
+		}()
+		conn, err = ln.AcceptSocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Req.Version != 5 || conn.Req.Target != "example.com:443" {
+			t.Errorf("unexpected SOCKS5 request %+v", conn.Req)
+		}
+		conn.Grant(nil)
+		if err := <-errs; err != nil {
+			t.Error("SOCKS5 handshake failed:", err)
+		}
+		conn.Close()
+	}
+
+	// When credentials are required, an empty USERID is refused.
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hookErrs := make(chan *SocksHandshakeError, 1)
+	ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+		AllowSocks4: true,
+		AuthMethods: []byte{SocksAuthUsernamePassword},
+		HandshakeErrorHook: func(err *SocksHandshakeError) {
+			hookErrs <- err
+		},
+	})
+	defer ln.Close()
+	go ln.AcceptSocks()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := socks4aClientHandshake(c, "example.com", 443, ""); err == nil {
+		t.Error("SOCKS4a handshake with empty USERID succeeded with AuthMethods requiring credentials")
+	}
+	select {
+	case err := <-hookErrs:
+		if err.Kind != SocksErrAuthFailed {
+			t.Errorf("empty USERID → %s (expected %s)", err.Kind, SocksErrAuthFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandshakeErrorHook not called")
+	}
+}
@@ -0,0 +1,155 @@
+package pt
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// The most bytes of encoded arguments that fit in the RFC 1929 username and
+// password fields together.
+const socksMaxArgsLen = 2 * 255
+
+// SocksReplyError is returned when a SOCKS5 server replies to a request with a
+// failure code.
+type SocksReplyError struct {
+	// The REP field of the reply, for example SocksRepConnectionRefused.
+	Code byte
+}
+
+func (err *SocksReplyError) Error() string {
+	var reason string
+	switch err.Code {
+	case SocksRepGeneralFailure:
+		reason = "general SOCKS server failure"
+	case SocksRepConnectionNotAllowed:
+		reason = "connection not allowed by ruleset"
+	case SocksRepNetworkUnreachable:
+		reason = "network unreachable"
+	case SocksRepHostUnreachable:
+		reason = "host unreachable"
+	case SocksRepConnectionRefused:
+		reason = "connection refused"
+	case SocksRepTTLExpired:
+		reason = "TTL expired"
+	case SocksRepCommandNotSupported:
+		reason = "command not supported"
+	case SocksRepAddressNotSupported:
+		reason = "address type not supported"
+	default:
+		reason = "unknown failure"
+	}
+	return fmt.Sprintf("SOCKS5 server replied with failure code 0x%02x (%s)", err.Code, reason)
+}
+
+// SocksDialer makes connections through the SOCKS5 server of a pluggable
+// transport client, such as the address in a CMETHOD line, passing Args the
+// way tor does: encoded in the RFC 1929 username and password. It is useful
+// for testing a transport client, or for driving one from a Go program.
+//
+// 	dialer := &pt.SocksDialer{
+// 		ProxyAddr: "127.0.0.1:5555",
+// 		Args:      pt.Args{"shared-secret": []string{"rahasia"}},
+// 	}
+// 	conn, err := dialer.Dial("tcp", "192.0.2.1:443")
+// 	if err != nil {
+// 		if e, ok := err.(*pt.SocksReplyError); ok {
+// 			log.Printf("SOCKS reply code 0x%02x", e.Code)
+// 		}
+// 		return err
+// 	}
+type SocksDialer struct {
+	// The "host:port" address of the SOCKS5 server.
+	ProxyAddr string
+	// Arguments to pass to the transport. If empty, no authentication is
+	// used.
+	Args Args
+	// Used to connect to ProxyAddr. If nil, a *net.Dialer is used.
+	Forward Dialer
+	// How long the SOCKS handshake may take, not counting the connection
+	// to ProxyAddr. If 0, a default of 30 seconds is used.
+	Timeout time.Duration
+}
+
+// Connect to the SOCKS5 server at proxyAddr and ask it to connect to target,
+// passing args. It is shorthand for a Dial call on a SocksDialer.
+func DialSocks(proxyAddr, target string, args Args) (net.Conn, error) {
+	d := &SocksDialer{ProxyAddr: proxyAddr, Args: args}
+	return d.Dial("tcp", target)
+}
+
+// Connect to address through the SOCKS5 server. network must be "tcp", "tcp4",
+// or "tcp6". If the server refuses the request, the error is a
+// *SocksReplyError.
+func (d *SocksDialer) Dial(network, address string) (net.Conn, error) {
+	if err := proxyCheckNetwork(network); err != nil {
+		return nil, err
+	}
+	host, port, err := proxySplitAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := socksEncodeAddr(host, port)
+	if err != nil {
+		return nil, err
+	}
+	user, err := socksArgsUserinfo(d.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = new(net.Dialer)
+	}
+	conn, err := forward.Dial("tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = proxyHandshakeTimeout
+	}
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Offer only username/password authentication when there are
+	// arguments, so that they cannot be silently dropped.
+	methods := []byte{SocksAuthNoneRequired}
+	if user != nil {
+		methods = []byte{SocksAuthUsernamePassword}
+	}
+	err = socks5ClientNegotiateAuth(conn, methods, user)
+	if err == nil {
+		err = socks5ClientConnect(conn, addr)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Encode args as an RFC 1929 username and password, the way tor does. The
+// encoded string goes in the username, up to its limit of 255 bytes, and the
+// rest in the password. If it all fits in the username, the password is a
+// single NUL byte. Returns nil if args is empty.
+func socksArgsUserinfo(args Args) (*url.Userinfo, error) {
+	s := encodeClientParameters(args)
+	if len(s) == 0 {
+		return nil, nil
+	}
+	if len(s) > socksMaxArgsLen {
+		return nil, fmt.Errorf("encoded SOCKS arguments are %d bytes, more than the maximum of %d", len(s), socksMaxArgsLen)
+	}
+	if len(s) <= 255 {
+		return url.UserPassword(s, "\x00"), nil
+	}
+	return url.UserPassword(s[:255], s[255:]), nil
+}
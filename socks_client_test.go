@@ -0,0 +1,107 @@
+package pt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocksArgsUserinfo(t *testing.T) {
+	user, err := socksArgsUserinfo(nil)
+	if err != nil || user != nil {
+		t.Errorf("nil args → %v, %v (expected nil, nil)", user, err)
+	}
+
+	user, err = socksArgsUserinfo(Args{"key": []string{"value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := user.Password()
+	if user.Username() != "key=value" || password != "\x00" {
+		t.Errorf("short args → %q %q (expected %q %q)", user.Username(), password, "key=value", "\x00")
+	}
+
+	long := strings.Repeat("x", 300)
+	user, err = socksArgsUserinfo(Args{"key": []string{long}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ = user.Password()
+	if len(user.Username()) != 255 || user.Username()+password != "key="+long {
+		t.Errorf("long args split as %d + %d bytes", len(user.Username()), len(password))
+	}
+
+	_, err = socksArgsUserinfo(Args{"key": []string{strings.Repeat("x", 510)}})
+	if err == nil {
+		t.Error("args longer than 510 bytes unexpectedly succeeded")
+	}
+}
+
+// Run a SocksListener that answers one request with code, and send the
+// request it received on the returned channel.
+func serveSocksOnce(t *testing.T, code byte) (*SocksListener, <-chan SocksRequest) {
+	ln, err := ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := make(chan SocksRequest, 1)
+	go func() {
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			close(reqs)
+			return
+		}
+		reqs <- conn.Req
+		if code == socksRepSucceeded {
+			conn.Grant(nil)
+			conn.Write([]byte("hello"))
+		} else {
+			conn.RejectReason(code)
+		}
+		conn.Close()
+	}()
+	return ln, reqs
+}
+
+func TestSocksDialer(t *testing.T) {
+	for _, args := range []Args{
+		nil,
+		{"key": []string{"value"}},
+		{"a": []string{"1", "2;3"}, "b": []string{strings.Repeat("x", 300)}},
+	} {
+		ln, reqs := serveSocksOnce(t, socksRepSucceeded)
+		d := &SocksDialer{ProxyAddr: ln.Addr().String(), Args: args, Timeout: 5 * time.Second}
+		conn, err := d.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Errorf("%q: Dial failed: %s", args, err)
+			ln.Close()
+			continue
+		}
+		req := <-reqs
+		if req.Target != "example.com:443" {
+			t.Errorf("%q: server got target %q", args, req.Target)
+		}
+		if !argsEqual(req.Args, args) {
+			t.Errorf("%q: server got args %q", args, req.Args)
+		}
+		if args == nil && req.Username != "" {
+			t.Errorf("%q: server got username %q (expected none)", args, req.Username)
+		}
+		buf := make([]byte, 5)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%q: read %q, %v after Dial", args, buf, err)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestSocksDialerReplyError(t *testing.T) {
+	ln, _ := serveSocksOnce(t, SocksRepConnectionRefused)
+	defer ln.Close()
+	_, err := DialSocks(ln.Addr().String(), "127.0.0.1:9", nil)
+	if e, ok := err.(*SocksReplyError); !ok || e.Code != SocksRepConnectionRefused {
+		t.Errorf("DialSocks returned %v (expected *SocksReplyError with code 0x%02x)", err, SocksRepConnectionRefused)
+	}
+}
@@ -3,10 +3,16 @@ package pt
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -54,7 +60,7 @@ func TestAuthInvalidVersion(t *testing.T) {
 
 	// VER = 03, NMETHODS = 01, METHODS = [00]
 	c.writeHex("030100")
-	if _, err := socksNegotiateAuth(c.toBufio()); err == nil {
+	if _, err := socksNegotiateAuth(c.toBufio(), nil); err == nil {
 		t.Error("socksNegotiateAuth(InvalidVersion) succeded")
 	}
 }
@@ -67,7 +73,7 @@ func TestAuthInvalidNMethods(t *testing.T) {
 
 	// VER = 05, NMETHODS = 00
 	c.writeHex("0500")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(No Methods) failed:", err)
 	}
 	if method != socksAuthNoAcceptableMethods {
@@ -86,10 +92,10 @@ func TestAuthNoneRequired(t *testing.T) {
 
 	// VER = 05, NMETHODS = 01, METHODS = [00]
 	c.writeHex("050100")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(None) failed:", err)
 	}
-	if method != socksAuthNoneRequired {
+	if method != SocksAuthNoneRequired {
 		t.Error("socksNegotiateAuth(None) unexpected method:", method)
 	}
 	if msg := c.readHex(); msg != "0500" {
@@ -105,10 +111,10 @@ func TestAuthUsernamePassword(t *testing.T) {
 
 	// VER = 05, NMETHODS = 01, METHODS = [02]
 	c.writeHex("050102")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(UsernamePassword) failed:", err)
 	}
-	if method != socksAuthUsernamePassword {
+	if method != SocksAuthUsernamePassword {
 		t.Error("socksNegotiateAuth(UsernamePassword) unexpected method:", method)
 	}
 	if msg := c.readHex(); msg != "0502" {
@@ -229,10 +235,10 @@ func TestAuthBoth(t *testing.T) {
 
 	// VER = 05, NMETHODS = 02, METHODS = [00, 02]
 	c.writeHex("05020002")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(Both) failed:", err)
 	}
-	if method != socksAuthUsernamePassword {
+	if method != SocksAuthUsernamePassword {
 		t.Error("socksNegotiateAuth(Both) unexpected method:", method)
 	}
 	if msg := c.readHex(); msg != "0502" {
@@ -248,7 +254,7 @@ func TestAuthUnsupported(t *testing.T) {
 
 	// VER = 05, NMETHODS = 01, METHODS = [01] (GSSAPI)
 	c.writeHex("050101")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(Unknown) failed:", err)
 	}
 	if method != socksAuthNoAcceptableMethods {
@@ -268,10 +274,10 @@ func TestAuthUnsupported2(t *testing.T) {
 
 	// VER = 05, NMETHODS = 03, METHODS = [00,01,02]
 	c.writeHex("0503000102")
-	if method, err = socksNegotiateAuth(c.toBufio()); err != nil {
+	if method, err = socksNegotiateAuth(c.toBufio(), nil); err != nil {
 		t.Error("socksNegotiateAuth(Unknown2) failed:", err)
 	}
-	if method != socksAuthUsernamePassword {
+	if method != SocksAuthUsernamePassword {
 		t.Error("socksNegotiateAuth(Unknown2) picked unexpected method:", method)
 	}
 	if msg := c.readHex(); msg != "0502" {
@@ -286,7 +292,7 @@ func TestRFC1929InvalidVersion(t *testing.T) {
 
 	// VER = 03, ULEN = 5, UNAME = "ABCDE", PLEN = 5, PASSWD = "abcde"
 	c.writeHex("03054142434445056162636465")
-	if err := socksAuthenticate(c.toBufio(), socksAuthUsernamePassword, &req); err == nil {
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, nil); err == nil {
 		t.Error("socksAuthenticate(InvalidVersion) succeded")
 	}
 	if msg := c.readHex(); msg != "0101" {
@@ -301,7 +307,7 @@ func TestRFC1929InvalidUlen(t *testing.T) {
 
 	// VER = 01, ULEN = 0, UNAME = "", PLEN = 5, PASSWD = "abcde"
 	c.writeHex("0100056162636465")
-	if err := socksAuthenticate(c.toBufio(), socksAuthUsernamePassword, &req); err == nil {
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, nil); err == nil {
 		t.Error("socksAuthenticate(InvalidUlen) succeded")
 	}
 	if msg := c.readHex(); msg != "0101" {
@@ -316,7 +322,7 @@ func TestRFC1929InvalidPlen(t *testing.T) {
 
 	// VER = 01, ULEN = 5, UNAME = "ABCDE", PLEN = 0, PASSWD = ""
 	c.writeHex("0105414243444500")
-	if err := socksAuthenticate(c.toBufio(), socksAuthUsernamePassword, &req); err == nil {
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, nil); err == nil {
 		t.Error("socksAuthenticate(InvalidPlen) succeded")
 	}
 	if msg := c.readHex(); msg != "0101" {
@@ -331,7 +337,7 @@ func TestRFC1929InvalidPTArgs(t *testing.T) {
 
 	// VER = 01, ULEN = 5, UNAME = "ABCDE", PLEN = 5, PASSWD = "abcde"
 	c.writeHex("01054142434445056162636465")
-	if err := socksAuthenticate(c.toBufio(), socksAuthUsernamePassword, &req); err == nil {
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, nil); err == nil {
 		t.Error("socksAuthenticate(InvalidArgs) succeded")
 	}
 	if msg := c.readHex(); msg != "0101" {
@@ -346,7 +352,7 @@ func TestRFC1929Success(t *testing.T) {
 
 	// VER = 01, ULEN = 9, UNAME = "key=value", PLEN = 1, PASSWD = "\0"
 	c.writeHex("01096b65793d76616c75650100")
-	if err := socksAuthenticate(c.toBufio(), socksAuthUsernamePassword, &req); err != nil {
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, nil); err != nil {
 		t.Error("socksAuthenticate(Success) failed:", err)
 	}
 	if msg := c.readHex(); msg != "0100" {
@@ -358,6 +364,49 @@ func TestRFC1929Success(t *testing.T) {
 	}
 }
 
+// TestRFC1929ValidateCredentials tests RFC1929 auth with a
+// SocksListenerConfig.ValidateCredentials function.
+func TestRFC1929ValidateCredentials(t *testing.T) {
+	c := new(testReadWriter)
+	var req SocksRequest
+	var username, password string
+	var args Args
+	config := &SocksListenerConfig{
+		ValidateCredentials: func(u, p string, a Args) error {
+			username, password, args = u, p, a
+			if v, _ := a.Get("key"); v != "value" {
+				return errors.New("bad key")
+			}
+			return nil
+		},
+	}
+
+	// VER = 01, ULEN = 9, UNAME = "key=value", PLEN = 1, PASSWD = "\0"
+	c.writeHex("01096b65793d76616c75650100")
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, config); err != nil {
+		t.Error("socksAuthenticate(Valid) failed:", err)
+	}
+	if msg := c.readHex(); msg != "0100" {
+		t.Error("socksAuthenticate(Valid) invalid response:", msg)
+	}
+	if username != "key=value" || password != "\x00" {
+		t.Errorf("ValidateCredentials got %q %q (expected %q %q)", username, password, "key=value", "\x00")
+	}
+	if v, ok := args.Get("key"); v != "value" || !ok {
+		t.Error("ValidateCredentials got unexpected args:", args)
+	}
+	c.reset()
+
+	// VER = 01, ULEN = 9, UNAME = "key=wrong", PLEN = 1, PASSWD = "\0"
+	c.writeHex("01096b65793d77726f6e670100")
+	if err := socksAuthenticate(c.toBufio(), SocksAuthUsernamePassword, &req, config); err == nil {
+		t.Error("socksAuthenticate(Invalid) succeeded")
+	}
+	if msg := c.readHex(); msg != "0101" {
+		t.Error("socksAuthenticate(Invalid) invalid response:", msg)
+	}
+}
+
 // TestRequestInvalidHdr tests SOCKS5 requests with invalid VER/CMD/RSV/ATYPE
 func TestRequestInvalidHdr(t *testing.T) {
 	c := new(testReadWriter)
@@ -365,7 +414,7 @@ func TestRequestInvalidHdr(t *testing.T) {
 
 	// VER = 03, CMD = 01, RSV = 00, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 9050
 	c.writeHex("030100017f000001235a")
-	if err := socksReadCommand(c.toBufio(), &req); err == nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
 		t.Error("socksReadCommand(InvalidVer) succeded")
 	}
 	if msg := c.readHex(); msg != "05010001000000000000" {
@@ -375,7 +424,7 @@ func TestRequestInvalidHdr(t *testing.T) {
 
 	// VER = 05, CMD = 05, RSV = 00, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 9050
 	c.writeHex("050500017f000001235a")
-	if err := socksReadCommand(c.toBufio(), &req); err == nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
 		t.Error("socksReadCommand(InvalidCmd) succeded")
 	}
 	if msg := c.readHex(); msg != "05070001000000000000" {
@@ -385,7 +434,7 @@ func TestRequestInvalidHdr(t *testing.T) {
 
 	// VER = 05, CMD = 01, RSV = 30, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 9050
 	c.writeHex("050130017f000001235a")
-	if err := socksReadCommand(c.toBufio(), &req); err == nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
 		t.Error("socksReadCommand(InvalidRsv) succeded")
 	}
 	if msg := c.readHex(); msg != "05010001000000000000" {
@@ -395,7 +444,7 @@ func TestRequestInvalidHdr(t *testing.T) {
 
 	// VER = 05, CMD = 01, RSV = 01, ATYPE = 05, DST.ADDR = 127.0.0.1, DST.PORT = 9050
 	c.writeHex("050100057f000001235a")
-	if err := socksReadCommand(c.toBufio(), &req); err == nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
 		t.Error("socksReadCommand(InvalidAtype) succeded")
 	}
 	if msg := c.readHex(); msg != "05080001000000000000" {
@@ -404,6 +453,80 @@ func TestRequestInvalidHdr(t *testing.T) {
 	c.reset()
 }
 
+// TestHandshakeFailureReplies tests that every failure in the SOCKS5 handshake
+// sends the client the reply appropriate to the stage it failed in.
+func TestHandshakeFailureReplies(t *testing.T) {
+	// Method negotiation, followed by authentication with the selected
+	// method, which fails immediately if no method was acceptable.
+	negotiate := func(rw *bufio.ReadWriter) error {
+		method, err := socksNegotiateAuth(rw, nil)
+		if err != nil {
+			return err
+		}
+		var req SocksRequest
+		return socksAuthenticate(rw, method, &req, nil)
+	}
+	rfc1929 := func(rw *bufio.ReadWriter) error {
+		var req SocksRequest
+		return socksAuthenticate(rw, SocksAuthUsernamePassword, &req, nil)
+	}
+	command := func(rw *bufio.ReadWriter) error {
+		var req SocksRequest
+		return socksReadCommand(rw, &req, nil)
+	}
+
+	tests := [...]struct {
+		name     string
+		stage    func(rw *bufio.ReadWriter) error
+		input    string
+		expected string
+	}{
+		{"bad version", negotiate, "040100", "05ff"},
+		{"empty", negotiate, "", "05ff"},
+		{"no NMETHODS", negotiate, "05", "05ff"},
+		{"short METHODS", negotiate, "050200", "05ff"},
+		{"no methods", negotiate, "0500", "05ff"},
+		{"unsupported method", negotiate, "050101", "05ff"},
+		{"extra data after methods", negotiate, "05010000", "05ff"},
+
+		{"bad auth version", rfc1929, "03054142434445056162636465", "0101"},
+		{"empty", rfc1929, "", "0101"},
+		{"no ULEN", rfc1929, "01", "0101"},
+		{"zero ULEN", rfc1929, "0100056162636465", "0101"},
+		{"short UNAME", rfc1929, "010541", "0101"},
+		{"no PLEN", rfc1929, "01054142434445", "0101"},
+		{"zero PLEN", rfc1929, "0105414243444500", "0101"},
+		{"short PASSWD", rfc1929, "010541424344450561", "0101"},
+		{"bad args", rfc1929, "01054142434445056162636465", "0101"},
+		{"extra data after auth", rfc1929, "01096b65793d76616c7565010000", "0101"},
+
+		{"bad version", command, "030100017f000001235a", "05010001000000000000"},
+		{"empty", command, "", "05010001000000000000"},
+		{"no CMD", command, "05", "05010001000000000000"},
+		{"unsupported CMD", command, "050500017f000001235a", "05070001000000000000"},
+		{"bad RSV", command, "050130017f000001235a", "05010001000000000000"},
+		{"no ATYP", command, "050100", "05010001000000000000"},
+		{"unsupported ATYP", command, "050100057f000001235a", "05080001000000000000"},
+		{"short IPv4 address", command, "050100017f00", "05010001000000000000"},
+		{"short IPv6 address", command, "050100040102030405060708", "05010001000000000000"},
+		{"no domain length", command, "05010003", "05010001000000000000"},
+		{"zero-length domain", command, "0501000300235a", "05010001000000000000"},
+		{"short domain", command, "050100030b6578616d", "05010001000000000000"},
+		{"short port", command, "050100017f00000123", "05010001000000000000"},
+		{"extra data after request", command, "050100017f000001235aff", "05010001000000000000"},
+	}
+	for _, test := range tests {
+		c := new(testReadWriter)
+		c.writeHex(test.input)
+		if err := test.stage(c.toBufio()); err == nil {
+			t.Errorf("%s %q unexpectedly succeeded", test.name, test.input)
+		}
+		if msg := c.readHex(); msg != test.expected {
+			t.Errorf("%s %q → %q (expected %q)", test.name, test.input, msg, test.expected)
+		}
+	}
+}
+
 // TestRequestIPv4 tests IPv4 SOCKS5 requests.
 func TestRequestIPv4(t *testing.T) {
 	c := new(testReadWriter)
@@ -411,7 +534,7 @@ func TestRequestIPv4(t *testing.T) {
 
 	// VER = 05, CMD = 01, RSV = 00, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 9050
 	c.writeHex("050100017f000001235a")
-	if err := socksReadCommand(c.toBufio(), &req); err != nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err != nil {
 		t.Error("socksReadCommand(IPv4) failed:", err)
 	}
 	addr, err := net.ResolveTCPAddr("tcp", req.Target)
@@ -421,6 +544,9 @@ func TestRequestIPv4(t *testing.T) {
 	if !tcpAddrsEqual(addr, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9050}) {
 		t.Error("Unexpected target:", addr)
 	}
+	if req.AddrType != SocksAddrIPv4 || req.Host != "127.0.0.1" || !req.IP.Equal(net.ParseIP("127.0.0.1")) || req.Port != 9050 {
+		t.Errorf("Unexpected structured target: %d %q %v %d", req.AddrType, req.Host, req.IP, req.Port)
+	}
 }
 
 // TestRequestIPv6 tests IPv4 SOCKS5 requests.
@@ -430,7 +556,7 @@ func TestRequestIPv6(t *testing.T) {
 
 	// VER = 05, CMD = 01, RSV = 00, ATYPE = 04, DST.ADDR = 0102:0304:0506:0708:090a:0b0c:0d0e:0f10, DST.PORT = 9050
 	c.writeHex("050100040102030405060708090a0b0c0d0e0f10235a")
-	if err := socksReadCommand(c.toBufio(), &req); err != nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err != nil {
 		t.Error("socksReadCommand(IPv6) failed:", err)
 	}
 	addr, err := net.ResolveTCPAddr("tcp", req.Target)
@@ -440,6 +566,9 @@ func TestRequestIPv6(t *testing.T) {
 	if !tcpAddrsEqual(addr, &net.TCPAddr{IP: net.ParseIP("0102:0304:0506:0708:090a:0b0c:0d0e:0f10"), Port: 9050}) {
 		t.Error("Unexpected target:", addr)
 	}
+	if req.AddrType != SocksAddrIPv6 || req.Host != "102:304:506:708:90a:b0c:d0e:f10" || !req.IP.Equal(addr.IP) || req.Port != 9050 {
+		t.Errorf("Unexpected structured target: %d %q %v %d", req.AddrType, req.Host, req.IP, req.Port)
+	}
 }
 
 // TestRequestFQDN tests FQDN (DOMAINNAME) SOCKS5 requests.
@@ -449,12 +578,15 @@ func TestRequestFQDN(t *testing.T) {
 
 	// VER = 05, CMD = 01, RSV = 00, ATYPE = 04, DST.ADDR = example.com, DST.PORT = 9050
 	c.writeHex("050100030b6578616d706c652e636f6d235a")
-	if err := socksReadCommand(c.toBufio(), &req); err != nil {
+	if err := socksReadCommand(c.toBufio(), &req, nil); err != nil {
 		t.Error("socksReadCommand(FQDN) failed:", err)
 	}
 	if req.Target != "example.com:9050" {
 		t.Error("Unexpected target:", req.Target)
 	}
+	if req.AddrType != SocksAddrDomainName || req.Host != "example.com" || req.IP != nil || req.Port != 9050 {
+		t.Errorf("Unexpected structured target: %d %q %v %d", req.AddrType, req.Host, req.IP, req.Port)
+	}
 }
 
 // TestResponseNil tests nil address SOCKS5 responses.
@@ -472,3 +604,613 @@ func TestResponseNil(t *testing.T) {
 }
 
 var _ io.ReadWriter = (*testReadWriter)(nil)
+
+// replyRecorder is a net.Conn that records what is written to it, for testing
+// the replies sent by SocksConn methods.
+type replyRecorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *replyRecorder) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *replyRecorder) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *replyRecorder) Close() error {
+	return nil
+}
+
+func (c *replyRecorder) readHex() string {
+	s := hex.EncodeToString(c.buf.Bytes())
+	c.buf.Reset()
+	return s
+}
+
+// TestReplyState tests that SocksConn sends exactly one reply, and allows
+// relaying data only after Grant.
+func TestReplyState(t *testing.T) {
+	rec := new(replyRecorder)
+	conn := &SocksConn{Conn: rec}
+	if _, err := conn.Write([]byte("data")); err == nil {
+		t.Error("Write before Grant succeeded")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != errSocksNotGranted {
+		t.Errorf("Read before Grant returned %v (expected %v)", err, errSocksNotGranted)
+	}
+	if err := conn.Grant(nil); err != nil {
+		t.Error("Grant failed:", err)
+	}
+	if err := conn.Grant(nil); err == nil {
+		t.Error("second Grant succeeded")
+	}
+	if err := conn.Reject(); err == nil {
+		t.Error("Reject after Grant succeeded")
+	}
+	if _, err := conn.Write([]byte("data")); err != nil {
+		t.Error("Write after Grant failed:", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after Grant returned %v (expected %v)", err, io.EOF)
+	}
+	conn.Close()
+	if msg := rec.readHex(); msg != "05000001000000000000"+hex.EncodeToString([]byte("data")) {
+		t.Error("unexpected output:", msg)
+	}
+
+	// Close with no reply sends General Failure.
+	conn = &SocksConn{Conn: rec}
+	conn.Close()
+	if msg := rec.readHex(); msg != "05010001000000000000" {
+		t.Error("Close without reply sent:", msg)
+	}
+
+	// Close after Reject sends nothing more, and data may not be relayed.
+	conn = &SocksConn{Conn: rec}
+	if err := conn.RejectReason(SocksRepConnectionRefused); err != nil {
+		t.Error("RejectReason failed:", err)
+	}
+	if _, err := conn.Write([]byte("data")); err == nil {
+		t.Error("Write after Reject succeeded")
+	}
+	conn.Close()
+	if msg := rec.readHex(); msg != "05050001000000000000" {
+		t.Error("Close after Reject sent:", msg)
+	}
+
+	// Close between the two BIND replies sends General Failure as the
+	// second.
+	conn = &SocksConn{Conn: rec, Req: SocksRequest{Command: SocksCmdBind}}
+	if err := conn.BindListening(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}); err != nil {
+		t.Error("BindListening failed:", err)
+	}
+	if _, err := conn.Write([]byte("data")); err == nil {
+		t.Error("Write before BindAccepted succeeded")
+	}
+	conn.Close()
+	if msg := rec.readHex(); msg != "050000010a0000010fa0"+"05010001000000000000" {
+		t.Error("Close after BindListening sent:", msg)
+	}
+}
+
+// TestBind tests the two replies to a BIND request.
+func TestBind(t *testing.T) {
+	c := new(testReadWriter)
+	var req SocksRequest
+
+	// VER = 05, CMD = 02, RSV = 00, ATYPE = 01, DST.ADDR = 127.0.0.1, DST.PORT = 9050
+	c.writeHex("050200017f000001235a")
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
+		t.Error("socksReadCommand(Bind) succeeded with default config")
+	}
+	c.reset()
+	c.writeHex("050200017f000001235a")
+	if err := socksReadCommand(c.toBufio(), &req, &SocksListenerConfig{Commands: []byte{SocksCmdBind}}); err != nil {
+		t.Error("socksReadCommand(Bind) failed:", err)
+	}
+	if req.Command != SocksCmdBind {
+		t.Errorf("Command 0x%02x (expected 0x%02x)", req.Command, SocksCmdBind)
+	}
+
+	rec := new(replyRecorder)
+	conn := &SocksConn{Conn: rec, Req: req}
+	if err := conn.BindAccepted(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 80}); err == nil {
+		t.Error("BindAccepted before BindListening succeeded")
+	}
+	if err := conn.BindListening(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}); err != nil {
+		t.Error("BindListening failed:", err)
+	}
+	if msg := rec.readHex(); msg != "050000010a0000010fa0" {
+		t.Error("BindListening invalid response:", msg)
+	}
+	if err := conn.BindAccepted(&net.TCPAddr{IP: net.ParseIP("1:2::3:4"), Port: 80}); err != nil {
+		t.Error("BindAccepted failed:", err)
+	}
+	if msg := rec.readHex(); msg != "05000004000100020000000000000000000300040050" {
+		t.Error("BindAccepted invalid response:", msg)
+	}
+
+	conn = &SocksConn{Conn: new(replyRecorder), Req: SocksRequest{Command: SocksCmdConnect}}
+	if err := conn.BindListening(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}); err == nil {
+		t.Error("BindListening succeeded for a CONNECT request")
+	}
+}
+
+// TestResolve tests the Tor RESOLVE and RESOLVE_PTR extensions.
+func TestResolve(t *testing.T) {
+	config := &SocksListenerConfig{Commands: []byte{SocksCmdResolve, SocksCmdResolvePTR}}
+	c := new(testReadWriter)
+	var req SocksRequest
+
+	// VER = 05, CMD = F0, RSV = 00, ATYPE = 03, DST.ADDR = example.com, DST.PORT = 0
+	c.writeHex("05f000030b6578616d706c652e636f6d0000")
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
+		t.Error("socksReadCommand(Resolve) succeeded with default config")
+	}
+	if msg := c.readHex(); msg != "05070001000000000000" {
+		t.Error("socksReadCommand(Resolve) invalid response:", msg)
+	}
+	c.reset()
+	c.writeHex("05f000030b6578616d706c652e636f6d0000")
+	if err := socksReadCommand(c.toBufio(), &req, config); err != nil {
+		t.Error("socksReadCommand(Resolve) failed:", err)
+	}
+	if req.Command != SocksCmdResolve || req.Target != "example.com:0" {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	rec := new(replyRecorder)
+	conn := &SocksConn{Conn: rec, Req: req}
+	if err := conn.GrantResolvePTR("example.com"); err == nil {
+		t.Error("GrantResolvePTR succeeded for a RESOLVE request")
+	}
+	if err := conn.GrantResolve(net.ParseIP("93.184.216.34")); err != nil {
+		t.Error("GrantResolve failed:", err)
+	}
+	if msg := rec.readHex(); msg != "050000015db8d8220000" {
+		t.Error("GrantResolve invalid response:", msg)
+	}
+	conn = &SocksConn{Conn: rec, Req: req}
+	if err := conn.GrantResolve(net.ParseIP("1:2::3:4")); err != nil {
+		t.Error("GrantResolve failed:", err)
+	}
+	if msg := rec.readHex(); msg != "05000004000100020000000000000000000300040000" {
+		t.Error("GrantResolve invalid response:", msg)
+	}
+
+	// VER = 05, CMD = F1, RSV = 00, ATYPE = 01, DST.ADDR = 93.184.216.34, DST.PORT = 0
+	c.reset()
+	c.writeHex("05f100015db8d8220000")
+	if err := socksReadCommand(c.toBufio(), &req, config); err != nil {
+		t.Error("socksReadCommand(ResolvePTR) failed:", err)
+	}
+	if req.Command != SocksCmdResolvePTR || req.Target != "93.184.216.34:0" {
+		t.Errorf("unexpected request %+v", req)
+	}
+	conn = &SocksConn{Conn: rec, Req: req}
+	if err := conn.GrantResolve(net.ParseIP("93.184.216.34")); err == nil {
+		t.Error("GrantResolve succeeded for a RESOLVE_PTR request")
+	}
+	if err := conn.GrantResolvePTR("1.2.3.4"); err == nil {
+		t.Error("GrantResolvePTR succeeded with an IP address")
+	}
+	if err := conn.GrantResolvePTR("example.com"); err != nil {
+		t.Error("GrantResolvePTR failed:", err)
+	}
+	if msg := rec.readHex(); msg != "050000030b6578616d706c652e636f6d0000" {
+		t.Error("GrantResolvePTR invalid response:", msg)
+	}
+	conn = &SocksConn{Conn: rec, Req: req}
+	if err := conn.RejectReason(SocksRepHostUnreachable); err != nil {
+		t.Error("RejectReason failed:", err)
+	}
+	if msg := rec.readHex(); msg != "05040001000000000000" {
+		t.Error("RejectReason invalid response:", msg)
+	}
+}
+
+// A net.Addr with a domain name in place of an IP address.
+type domainAddr string
+
+func (addr domainAddr) Network() string { return "tcp" }
+func (addr domainAddr) String() string  { return string(addr) }
+
+// TestGrant tests the BND.ADDR/BND.PORT sent by Grant and GrantAddr.
+func TestGrant(t *testing.T) {
+	tests := [...]struct {
+		addr     net.Addr
+		expected string
+	}{
+		{nil, "05000001000000000000"},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9050}, "050000017f000001235a"},
+		{&net.TCPAddr{IP: net.ParseIP("0102:0304:0506:0708:090a:0b0c:0d0e:0f10"), Port: 9050}, "050000040102030405060708090a0b0c0d0e0f10235a"},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, "050000017f0000010035"},
+		// A nil IP is 0.0.0.0.
+		{&net.TCPAddr{Port: 9050}, "0500000100000000235a"},
+		{&net.UDPAddr{Port: 53}, "05000001000000000035"},
+		{domainAddr("example.com:9050"), "050000030b6578616d706c652e636f6d235a"},
+	}
+	for _, test := range tests {
+		rec := new(replyRecorder)
+		conn := &SocksConn{Conn: rec}
+		if err := conn.GrantAddr(test.addr); err != nil {
+			t.Errorf("GrantAddr(%v) failed: %s", test.addr, err)
+		}
+		if msg := rec.readHex(); msg != test.expected {
+			t.Errorf("GrantAddr(%v) → %s (expected %s)", test.addr, msg, test.expected)
+		}
+		if tcpAddr, ok := test.addr.(*net.TCPAddr); ok || test.addr == nil {
+			conn = &SocksConn{Conn: rec}
+			if err := conn.Grant(tcpAddr); err != nil {
+				t.Errorf("Grant(%v) failed: %s", test.addr, err)
+			}
+			if msg := rec.readHex(); msg != test.expected {
+				t.Errorf("Grant(%v) → %s (expected %s)", test.addr, msg, test.expected)
+			}
+		}
+	}
+
+	conn := &SocksConn{Conn: new(replyRecorder)}
+	if err := conn.GrantAddr(domainAddr("example.com")); err == nil {
+		t.Error("GrantAddr with no port succeeded")
+	}
+}
+
+// A net.Error that is a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestRejectError tests the reply codes chosen by RejectError.
+func TestRejectError(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := [...]struct {
+		err  error
+		code byte
+	}{
+		{dialErr(syscall.ECONNREFUSED), SocksRepConnectionRefused},
+		{dialErr(syscall.EHOSTUNREACH), SocksRepHostUnreachable},
+		{dialErr(syscall.ENETUNREACH), SocksRepNetworkUnreachable},
+		{dialErr(syscall.ETIMEDOUT), SocksRepTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, SocksRepTTLExpired},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), SocksRepTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, SocksRepHostUnreachable},
+		{&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, SocksRepTTLExpired},
+		{errors.New("something else"), SocksRepGeneralFailure},
+		{nil, SocksRepGeneralFailure},
+	}
+	for _, test := range tests {
+		rec := new(replyRecorder)
+		conn := &SocksConn{Conn: rec}
+		if err := conn.RejectError(test.err); err != nil {
+			t.Errorf("RejectError(%v) failed: %s", test.err, err)
+		}
+		expected := fmt.Sprintf("05%02x0001000000000000", test.code)
+		if msg := rec.readHex(); msg != expected {
+			t.Errorf("RejectError(%v) → %s (expected %s)", test.err, msg, expected)
+		}
+	}
+
+	// A real refused connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("connection to closed port unexpectedly succeeded")
+	}
+	if code := socksRepForError(err); code != SocksRepConnectionRefused {
+		t.Errorf("%v → 0x%02x (expected 0x%02x)", err, code, SocksRepConnectionRefused)
+	}
+}
+
+// TestAuthMethodsConfig tests negotiation restricted by
+// SocksListenerConfig.AuthMethods.
+func TestAuthMethodsConfig(t *testing.T) {
+	c := new(testReadWriter)
+	var method byte
+	var err error
+	config := &SocksListenerConfig{AuthMethods: []byte{SocksAuthUsernamePassword}}
+
+	// VER = 05, NMETHODS = 01, METHODS = [00]
+	c.writeHex("050100")
+	if method, err = socksNegotiateAuth(c.toBufio(), config); err != nil {
+		t.Error("socksNegotiateAuth(None) failed:", err)
+	}
+	if method != socksAuthNoAcceptableMethods {
+		t.Error("socksNegotiateAuth(None) picked unexpected method:", method)
+	}
+	if msg := c.readHex(); msg != "05ff" {
+		t.Error("socksNegotiateAuth(None) invalid response:", msg)
+	}
+	c.reset()
+
+	config = &SocksListenerConfig{AuthMethods: []byte{SocksAuthNoneRequired}}
+	// VER = 05, NMETHODS = 02, METHODS = [00, 02]
+	c.writeHex("05020002")
+	if method, err = socksNegotiateAuth(c.toBufio(), config); err != nil {
+		t.Error("socksNegotiateAuth(Both) failed:", err)
+	}
+	if method != SocksAuthNoneRequired {
+		t.Error("socksNegotiateAuth(Both) picked unexpected method:", method)
+	}
+	if msg := c.readHex(); msg != "0500" {
+		t.Error("socksNegotiateAuth(Both) invalid response:", msg)
+	}
+}
+
+// Connect to addr and send a SOCKS5 CONNECT request for 127.0.0.1:port with
+// no authentication, returning the connection. The reply is not read.
+func dialSocksTest(t *testing.T, addr net.Addr, port int) net.Conn {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		c.Write([]byte("\x05\x01\x00"))
+		io.ReadFull(c, make([]byte, 2))
+		c.Write([]byte{0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, byte(port >> 8), byte(port)})
+	}()
+	return c
+}
+
+// TestSocksListenerConfigHooks tests HandshakeTimeout, AcceptHook, and
+// RequestHook.
+func TestSocksListenerConfigHooks(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requested int32
+	ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+		HandshakeTimeout: 50 * time.Millisecond,
+		RequestHook: func(req *SocksRequest) byte {
+			atomic.AddInt32(&requested, 1)
+			if req.Target == "127.0.0.1:1" {
+				return SocksRepConnectionNotAllowed
+			}
+			return 0
+		},
+	})
+	defer ln.Close()
+
+	// The first client is refused by RequestHook, and the second is silent
+	// and times out. AcceptSocks returns only the third.
+	c1 := dialSocksTest(t, ln.Addr(), 1)
+	defer c1.Close()
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	c3 := dialSocksTest(t, ln.Addr(), 9050)
+	defer c3.Close()
+
+	conn, err := ln.AcceptSocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Req.Target != "127.0.0.1:9050" {
+		t.Error("Unexpected target:", conn.Req.Target)
+	}
+
+	resp, _ := ioutil.ReadAll(c1)
+	if msg := hex.EncodeToString(resp); msg != "05020001000000000000" {
+		t.Error("RequestHook rejection invalid response:", msg)
+	}
+	if n := atomic.LoadInt32(&requested); n != 2 {
+		t.Errorf("RequestHook called %d times (expected 2)", n)
+	}
+	resp, err = ioutil.ReadAll(c2)
+	if err != nil || len(resp) != 0 {
+		t.Errorf("silent client read %x, %v (expected EOF)", resp, err)
+	}
+
+	// A listener whose AcceptHook refuses everything closes connections
+	// without sending anything.
+	tcpLn, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	ln2 := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+		AcceptHook: func(c net.Conn) error {
+			atomic.AddInt32(&accepted, 1)
+			return errors.New("refused")
+		},
+	})
+	defer ln2.Close()
+	go ln2.AcceptSocks()
+	c4 := dialSocksTest(t, ln2.Addr(), 9050)
+	defer c4.Close()
+	resp, _ = ioutil.ReadAll(c4)
+	if len(resp) != 0 {
+		t.Errorf("AcceptHook rejection sent %x", resp)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("AcceptHook called %d times (expected 1)", n)
+	}
+}
+
+// TestAcceptSocksConcurrent tests that a client that does not send its request
+// does not hold up AcceptSocks for the clients after it.
+func TestAcceptSocksConcurrent(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewSocksListener(tcpLn)
+	defer ln.Close()
+
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	for _, port := range []int{1, 2, 3} {
+		c := dialSocksTest(t, ln.Addr(), port)
+		defer c.Close()
+	}
+
+	// The default handshake timeout is much longer than this.
+	timer := time.AfterFunc(2*time.Second, func() { ln.Close() })
+	defer timer.Stop()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			t.Fatalf("AcceptSocks returned %v after %d connections", err, i)
+		}
+		defer conn.Close()
+		seen[conn.Req.Target] = true
+	}
+	for _, target := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+		if !seen[target] {
+			t.Errorf("AcceptSocks did not return %s", target)
+		}
+	}
+
+	// After Close, AcceptSocks returns a permanent error.
+	ln.Close()
+	_, err = ln.AcceptSocks()
+	if err == nil {
+		t.Fatal("AcceptSocks after Close unexpectedly succeeded")
+	}
+	if e, ok := err.(net.Error); ok && e.Temporary() {
+		t.Errorf("AcceptSocks after Close returned a temporary error: %v", err)
+	}
+}
+
+// TestMaxConcurrentHandshakes tests that a handshake does not start while
+// MaxConcurrentHandshakes others are in progress.
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	for _, limit := range []int{1, 2} {
+		tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+			HandshakeTimeout:        timeout,
+			MaxConcurrentHandshakes: limit,
+		})
+		defer ln.Close()
+
+		// With a limit of 1, the silent client holds the only slot
+		// until it times out.
+		silent, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+		c := dialSocksTest(t, ln.Addr(), 1)
+		defer c.Close()
+
+		start := time.Now()
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		elapsed := time.Since(start)
+		if limit == 1 && elapsed < timeout/2 {
+			t.Errorf("limit %d: handshake finished after %v, before the silent client timed out", limit, elapsed)
+		}
+		if limit == 2 && elapsed >= timeout/2 {
+			t.Errorf("limit %d: handshake took %v, waiting for the silent client", limit, elapsed)
+		}
+	}
+}
+
+// Connect to addr and send msgs, reading the 2-byte reply to each message but
+// the last. The connection is returned without reading the final reply.
+func dialSocksScript(t *testing.T, addr net.Addr, msgs ...string) net.Conn {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for i, msg := range msgs {
+			b, _ := hex.DecodeString(msg)
+			c.Write(b)
+			if i < len(msgs)-1 {
+				io.ReadFull(c, make([]byte, 2))
+			}
+		}
+	}()
+	return c
+}
+
+// TestHandshakeErrorHook tests that handshake failures are classified, passed
+// to HandshakeErrorHook, and counted.
+func TestHandshakeErrorHook(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan *SocksHandshakeError, 10)
+	ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+		HandshakeTimeout: 50 * time.Millisecond,
+		HandshakeErrorHook: func(err *SocksHandshakeError) {
+			errs <- err
+		},
+	})
+	defer ln.Close()
+	go ln.AcceptSocks()
+
+	tests := [...]struct {
+		msgs []string
+		kind SocksHandshakeErrorKind
+	}{
+		// VER = 04
+		{[]string{"040100"}, SocksErrBadVersion},
+		// Username/password "key" and "\0", which is not a valid
+		// argument string.
+		{[]string{"050102", "01036b65790100"}, SocksErrBadArgs},
+		// ATYPE = 05
+		{[]string{"050100", "05010005"}, SocksErrUnsupportedAddrType},
+		// CMD = 02 (BIND)
+		{[]string{"050100", "05020001000000000000"}, SocksErrUnsupportedCommand},
+		// A byte after DST.PORT.
+		{[]string{"050100", "050100017f0000010001ff"}, SocksErrMalformed},
+		// Silent.
+		{nil, SocksErrTimeout},
+	}
+	for _, test := range tests {
+		c := dialSocksScript(t, ln.Addr(), test.msgs...)
+		select {
+		case err := <-errs:
+			if err.Kind != test.kind {
+				t.Errorf("%v → %s (expected %s)", test.msgs, err.Kind, test.kind)
+			}
+			if err.RemoteAddr.String() != c.LocalAddr().String() {
+				t.Errorf("%v → RemoteAddr %s (expected %s)", test.msgs, err.RemoteAddr, c.LocalAddr())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: HandshakeErrorHook not called", test.msgs)
+		}
+		c.Close()
+	}
+	for _, test := range tests {
+		if n := ln.HandshakeErrorCount(test.kind); n != 1 {
+			t.Errorf("HandshakeErrorCount(%s) → %d (expected 1)", test.kind, n)
+		}
+	}
+	if n := ln.HandshakeErrorCount(SocksErrOther); n != 0 {
+		t.Errorf("HandshakeErrorCount(%s) → %d (expected 0)", SocksErrOther, n)
+	}
+}
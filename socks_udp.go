@@ -0,0 +1,234 @@
+package pt
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The largest UDP payload we expect to relay.
+const socksMaxDatagramSize = 65535
+
+// SocksPacketConn relays datagrams for a SOCKS5 UDP ASSOCIATE request. It is
+// returned by SocksConn.GrantUDP. The client sends datagrams to the relay
+// socket's address, each prefixed by the UDP request header of RFC 1928
+// section 7; SocksPacketConn removes and adds that header so you deal only in
+// payloads and destination addresses.
+//
+// 	pc, err := conn.GrantUDP()
+// 	if err != nil {
+// 		return err
+// 	}
+// 	defer pc.Close()
+// 	buf := make([]byte, 65535)
+// 	for {
+// 		n, dst, err := pc.ReadPacket(buf)
+// 		if err != nil {
+// 			return err
+// 		}
+// 		// send buf[:n] to dst, and send replies back with
+// 		// pc.WritePacket(reply, src)
+// 	}
+type SocksPacketConn struct {
+	conn *net.UDPConn
+
+	// Guards readBuf, which holds each datagram as ReadPacket decodes it.
+	readMu  sync.Mutex
+	readBuf []byte
+
+	mu sync.Mutex
+	// The IP address and port from which the client is expected to send.
+	// clientPort is 0 if any port is acceptable.
+	clientIP   net.IP
+	clientPort int
+	// The address of the client, once a datagram has been received from it.
+	clientAddr *net.UDPAddr
+}
+
+// Send a reply to a UDP ASSOCIATE request, granting it, and return a
+// SocksPacketConn for relaying the client's datagrams. The relay socket listens
+// on the same IP address as the SOCKS connection, and that address is sent to
+// the client in BND.ADDR/BND.PORT. If the relay socket cannot be opened, the
+// request is rejected with a "General Failure" error code.
+//
+// The relay socket is closed when the SOCKS connection is closed (by either
+// side), as RFC 1928 requires, or when you call Close on the SocksPacketConn.
+// Do not read from or write to conn after calling GrantUDP.
+func (conn *SocksConn) GrantUDP() (*SocksPacketConn, error) {
+	if conn.Req.Command != SocksCmdUDPAssociate {
+		return nil, fmt.Errorf("GrantUDP called for SOCKS command 0x%02x", conn.Req.Command)
+	}
+
+	laddr := &net.UDPAddr{}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = local.IP
+	}
+	udpConn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		conn.Reject()
+		return nil, err
+	}
+	bnd, err := socksEncodeNetAddr(udpConn.LocalAddr())
+	if err != nil {
+		udpConn.Close()
+		conn.Reject()
+		return nil, err
+	}
+	pc := newSocksPacketConn(udpConn, conn.RemoteAddr(), conn.Req.Target)
+	err = conn.reply(socksNoReply, socksGranted, socksRepSucceeded, bnd)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	go func() {
+		// "A UDP association terminates when the TCP connection that
+		// the UDP ASSOCIATE request arrived on terminates."
+		io.Copy(ioutil.Discard, conn.Conn)
+		pc.Close()
+	}()
+
+	return pc, nil
+}
+
+// Return a SocksPacketConn that relays over udpConn for a client whose SOCKS
+// connection comes from remote, and which asked to send from target.
+func newSocksPacketConn(udpConn *net.UDPConn, remote net.Addr, target string) *SocksPacketConn {
+	pc := &SocksPacketConn{conn: udpConn, readBuf: make([]byte, socksMaxDatagramSize)}
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		pc.clientIP = addr.IP
+	}
+	// The client may tell us in DST.ADDR/DST.PORT where it will send from,
+	// or may leave them zero if it does not know.
+	host, portStr, err := net.SplitHostPort(target)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			pc.clientIP = ip
+		}
+		if port, err := parsePort(portStr); err == nil {
+			pc.clientPort = port
+		}
+	}
+	return pc
+}
+
+// Report whether a datagram from addr may have come from the client, and if
+// so, remember addr as the client's address.
+func (c *SocksPacketConn) checkSource(addr *net.UDPAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clientAddr != nil {
+		return addr.IP.Equal(c.clientAddr.IP) && addr.Port == c.clientAddr.Port
+	}
+	if c.clientIP != nil && !addr.IP.Equal(c.clientIP) {
+		return false
+	}
+	if c.clientPort != 0 && addr.Port != c.clientPort {
+		return false
+	}
+	c.clientAddr = addr
+	return true
+}
+
+// Read the next datagram from the client, copy its payload into p, and return
+// the number of bytes copied and the destination that the client asked for as
+// a "host:port" string, where host may be an IP address or a domain name.
+// Datagrams that come from a source other than the client, that are malformed,
+// or that are fragments (FRAG other than 0) are silently dropped. As with any
+// datagram socket, a payload longer than p is truncated.
+func (c *SocksPacketConn) ReadPacket(p []byte) (n int, dst string, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	buf := c.readBuf
+	for {
+		m, addr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, "", err
+		}
+		// +----+------+------+----------+----------+----------+
+		// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		// +----+------+------+----------+----------+----------+
+		// | 2  |  1   |  1   | Variable |    2     | Variable |
+		// +----+------+------+----------+----------+----------+
+		if m < 3 || buf[0] != socksRsv || buf[1] != socksRsv || buf[2] != 0 {
+			continue
+		}
+		host, port, hdrLen, err := socksDecodeAddr(buf[3:m])
+		if err != nil {
+			continue
+		}
+		if !c.checkSource(addr) {
+			continue
+		}
+		n = copy(p, buf[3+hdrLen:m])
+		return n, net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+}
+
+// Send p to the client as a datagram that came from src, a "host:port" string
+// where host may be an IP address or a domain name. Returns an error if no
+// datagram has yet been received from the client, unless the client said in
+// its request exactly which address it would send from.
+func (c *SocksPacketConn) WritePacket(p []byte, src string) (int, error) {
+	host, portStr, err := net.SplitHostPort(src)
+	if err != nil {
+		return 0, err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return 0, err
+	}
+	hdr, err := socksEncodeAddr(host, port)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	clientAddr := c.clientAddr
+	if clientAddr == nil && c.clientIP != nil && c.clientPort != 0 {
+		clientAddr = &net.UDPAddr{IP: c.clientIP, Port: c.clientPort}
+	}
+	c.mu.Unlock()
+	if clientAddr == nil {
+		return 0, fmt.Errorf("client address of UDP association is not yet known")
+	}
+
+	msg := make([]byte, 0, 3+len(hdr)+len(p))
+	msg = append(msg, socksRsv, socksRsv, 0)
+	msg = append(msg, hdr...)
+	msg = append(msg, p...)
+	_, err = c.conn.WriteToUDP(msg, clientAddr)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close the relay socket.
+func (c *SocksPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+// Return the address of the relay socket.
+func (c *SocksPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Set the read and write deadlines of the relay socket.
+func (c *SocksPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Set the read deadline of the relay socket.
+func (c *SocksPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Set the write deadline of the relay socket.
+func (c *SocksPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
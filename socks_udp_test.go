@@ -0,0 +1,164 @@
+package pt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRequestUDPAssociate tests that UDP ASSOCIATE is rejected unless enabled.
+func TestRequestUDPAssociate(t *testing.T) {
+	c := new(testReadWriter)
+	var req SocksRequest
+
+	// VER = 05, CMD = 03, RSV = 00, ATYPE = 01, DST.ADDR = 0.0.0.0, DST.PORT = 0
+	c.writeHex("05030001000000000000")
+	if err := socksReadCommand(c.toBufio(), &req, nil); err == nil {
+		t.Error("socksReadCommand(UDPAssociate) succeeded with default config")
+	}
+	if msg := c.readHex(); msg != "05070001000000000000" {
+		t.Error("socksReadCommand(UDPAssociate) invalid response:", msg)
+	}
+	c.reset()
+
+	config := &SocksListenerConfig{Commands: []byte{SocksCmdConnect, SocksCmdUDPAssociate}}
+	c.writeHex("05030001000000000000")
+	if err := socksReadCommand(c.toBufio(), &req, config); err != nil {
+		t.Error("socksReadCommand(UDPAssociate) failed:", err)
+	}
+	if req.Command != SocksCmdUDPAssociate {
+		t.Errorf("Command 0x%02x (expected 0x%02x)", req.Command, SocksCmdUDPAssociate)
+	}
+	if req.Target != "0.0.0.0:0" {
+		t.Error("Unexpected target:", req.Target)
+	}
+}
+
+func TestSocksDecodeAddr(t *testing.T) {
+	tests := [...]struct {
+		input string
+		host  string
+		port  int
+		n     int
+	}{
+		{"017f000001235a", "127.0.0.1", 9050, 7},
+		{"017f000001235aff", "127.0.0.1", 9050, 7},
+		{"030b6578616d706c652e636f6d0035", "example.com", 53, 15},
+		{"040102030405060708090a0b0c0d0e0f10235a", "102:304:506:708:90a:b0c:d0e:f10", 9050, 19},
+	}
+	for _, test := range tests {
+		b, _ := hex.DecodeString(test.input)
+		host, port, n, err := socksDecodeAddr(b)
+		if err != nil {
+			t.Errorf("%s unexpectedly returned an error: %s", test.input, err)
+			continue
+		}
+		if host != test.host || port != test.port || n != test.n {
+			t.Errorf("%s → %q %d %d (expected %q %d %d)", test.input, host, port, n, test.host, test.port, test.n)
+		}
+	}
+
+	for _, input := range []string{"", "01", "017f000001", "0300", "03056162", "050000"} {
+		b, _ := hex.DecodeString(input)
+		_, _, _, err := socksDecodeAddr(b)
+		if err == nil {
+			t.Errorf("%q unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestGrantUDP(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := NewSocksListenerConfig(tcpLn, SocksListenerConfig{
+		Commands: []byte{SocksCmdUDPAssociate},
+	})
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		// Method negotiation, then UDP ASSOCIATE 0.0.0.0:0.
+		client.Write([]byte("\x05\x01\x00"))
+		io.ReadFull(client, make([]byte, 2))
+		client.Write([]byte("\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00"))
+	}()
+
+	conn, err := ln.AcceptSocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Req.Command != SocksCmdUDPAssociate {
+		t.Fatalf("Command 0x%02x (expected 0x%02x)", conn.Req.Command, SocksCmdUDPAssociate)
+	}
+	pc, err := conn.GrantUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp[:4], []byte{0x05, 0x00, 0x00, 0x01}) {
+		t.Fatalf("bad reply %x", resp)
+	}
+	host, port, _, err := socksDecodeAddr(resp[3:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayAddr := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+	if !relayAddr.IP.Equal(pc.LocalAddr().(*net.UDPAddr).IP) || relayAddr.Port != pc.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("BND %s does not match relay address %s", relayAddr, pc.LocalAddr())
+	}
+
+	udpClient, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpClient.Close()
+	udpClient.SetDeadline(time.Now().Add(5 * time.Second))
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A fragment is dropped; the following whole datagram is delivered.
+	udpClient.Write([]byte("\x00\x00\x01\x01\x01\x02\x03\x04\x00\x35fragment"))
+	udpClient.Write([]byte("\x00\x00\x00\x03\x0bexample.com\x00\x35hello"))
+	buf := make([]byte, 100)
+	n, dst, err := pc.ReadPacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst != "example.com:53" || string(buf[:n]) != "hello" {
+		t.Errorf("ReadPacket → %q %q (expected %q %q)", dst, buf[:n], "example.com:53", "hello")
+	}
+
+	_, err = pc.WritePacket([]byte("reply"), "1.2.3.4:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = udpClient.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "\x00\x00\x00\x01\x01\x02\x03\x04\x00\x35reply" {
+		t.Errorf("client received %x", buf[:n])
+	}
+
+	// Closing the SOCKS connection closes the relay.
+	client.Close()
+	_, _, err = pc.ReadPacket(buf)
+	if err == nil {
+		t.Errorf("ReadPacket after closing the SOCKS connection unexpectedly succeeded")
+	}
+}